@@ -0,0 +1,93 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"strings"
+)
+
+type (
+	// IPRules 按 CIDR 限制来源地址，DenyFrom 优先，AllowFrom 为空时允许其余所有地址
+	IPRules struct {
+		AllowFrom []string `json:"AllowFrom"` // 如 10.0.0.0/8、192.168.1.10、::1
+		DenyFrom  []string `json:"DenyFrom"`
+	}
+)
+
+// Allowed 判断地址是否允许访问，规则格式错误时返回错误
+func (r IPRules) Allowed(addr netip.Addr) (bool, error) {
+	if !addr.IsValid() {
+		// unix socket 等没有 IP 的连接不做限制
+		return true, nil
+	}
+	addr = addr.Unmap()
+	matched, err := matchPrefixes(r.DenyFrom, addr)
+	if err != nil || matched {
+		return false, err
+	}
+	if len(r.AllowFrom) == 0 {
+		return true, nil
+	}
+	return matchPrefixes(r.AllowFrom, addr)
+}
+
+// Validate 检查规则格式，配置加载时调用
+func (r IPRules) Validate() error {
+	for _, rule := range append(append([]string{}, r.AllowFrom...), r.DenyFrom...) {
+		if _, err := parsePrefix(rule); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func matchPrefixes(rules []string, addr netip.Addr) (bool, error) {
+	for _, rule := range rules {
+		prefix, err := parsePrefix(rule)
+		if err != nil {
+			return false, err
+		}
+		if prefix.Contains(addr) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// parsePrefix 解析 CIDR 或单个 IP，IPv4 映射的 IPv6 前缀转换为 IPv4 前缀
+func parsePrefix(rule string) (netip.Prefix, error) {
+	rule = strings.TrimSpace(rule)
+	var prefix netip.Prefix
+	if strings.Contains(rule, "/") {
+		p, err := netip.ParsePrefix(rule)
+		if err != nil {
+			return prefix, errors.New(fmt.Sprintf("parse cidr %q err:%s", rule, err.Error()))
+		}
+		prefix = p
+	} else {
+		addr, err := netip.ParseAddr(rule)
+		if err != nil {
+			return prefix, errors.New(fmt.Sprintf("parse ip %q err:%s", rule, err.Error()))
+		}
+		prefix = netip.PrefixFrom(addr, addr.BitLen())
+	}
+	if prefix.Addr().Is4In6() && prefix.Bits() >= 96 {
+		prefix = netip.PrefixFrom(prefix.Addr().Unmap(), prefix.Bits()-96)
+	}
+	return prefix.Masked(), nil
+}
+
+// remoteAddr 取出连接的 IP，非 TCP 连接返回无效地址
+func remoteAddr(addr net.Addr) netip.Addr {
+	if tcp, ok := addr.(*net.TCPAddr); ok {
+		ip, _ := netip.AddrFromSlice(tcp.IP)
+		return ip.Unmap()
+	}
+	ip, err := netip.ParseAddr(remoteIP(addr))
+	if err != nil {
+		return netip.Addr{}
+	}
+	return ip.WithZone("").Unmap()
+}
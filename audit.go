@@ -0,0 +1,143 @@
+package main
+
+import (
+	"encoding/json"
+	sshd "github.com/gliderlabs/ssh"
+	"golang.org/x/crypto/ssh"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	AuditEventAuth        = "auth"
+	AuditEventExec        = "exec"
+	AuditEventSCPUpload   = "scp_upload"
+	AuditEventSCPDownload = "scp_download"
+	AuditEventSFTPOpen    = "sftp_open"
+	AuditEventSFTPWrite   = "sftp_write"
+	AuditEventSFTPRead    = "sftp_read"
+	AuditEventSFTPRemove  = "sftp_remove"
+	AuditEventSFTPRename  = "sftp_rename"
+	AuditEventSFTPMkdir   = "sftp_mkdir"
+	AuditEventSFTPRmdir   = "sftp_rmdir"
+
+	AuditResultSuccess = "success"
+	AuditResultFailure = "failure"
+	AuditResultPartial = "partial" // 第一步认证通过，还需要验证码
+)
+
+type (
+	AuditConfig struct {
+		File string `json:"File"` // 审计日志文件，为空时不记录
+	}
+
+	// Auditor 以 JSON 行的形式追加写入审计日志，没有打开文件时不记录
+	Auditor struct {
+		mu sync.Mutex
+		f  *os.File
+	}
+
+	AuditEvent struct {
+		Time        string `json:"time"`
+		Event       string `json:"event"`
+		Session     string `json:"session,omitempty"`
+		User        string `json:"user,omitempty"`
+		Remote      string `json:"remote,omitempty"`
+		Method      string `json:"method,omitempty"`
+		Fingerprint string `json:"fingerprint,omitempty"`
+		Command     string `json:"command,omitempty"`
+		Path        string `json:"path,omitempty"`
+		Target      string `json:"target,omitempty"`
+		Flags       string `json:"flags,omitempty"`
+		Size        int64  `json:"size,omitempty"`
+		Result      string `json:"result,omitempty"`
+		Error       string `json:"error,omitempty"`
+	}
+)
+
+func NewAuditor(cfg AuditConfig) (*Auditor, error) {
+	a := &Auditor{}
+	if err := a.Open(cfg); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// Open 按配置打开审计文件并关闭之前的文件，File 为空时停止记录。
+// 重新加载配置时调用，文件不变时相当于重新打开，便于配合 logrotate 使用
+func (a *Auditor) Open(cfg AuditConfig) error {
+	if a == nil {
+		return nil
+	}
+	var f *os.File
+	if cfg.File != "" {
+		var err error
+		f, err = os.OpenFile(cfg.File, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+		if err != nil {
+			return err
+		}
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.f != nil {
+		_ = a.f.Close()
+	}
+	a.f = f
+	return nil
+}
+
+func (a *Auditor) Log(ev AuditEvent) {
+	if a == nil {
+		return
+	}
+	if ev.Time == "" {
+		ev.Time = time.Now().Format(time.RFC3339Nano)
+	}
+	data, err := json.Marshal(ev)
+	if err != nil {
+		return
+	}
+	data = append(data, '\n')
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.f != nil {
+		_, _ = a.f.Write(data)
+	}
+}
+
+// Session 记录与会话相关的事件，自动填充会话信息
+func (a *Auditor) Session(sess sshd.Session, ev AuditEvent) {
+	if a == nil {
+		return
+	}
+	ctx := sess.Context()
+	ev.Session = shortSessionID(ctx)
+	ev.User = ctx.User()
+	ev.Remote = ctx.RemoteAddr().String()
+	a.Log(ev)
+}
+
+func (a *Auditor) Close() error {
+	if a == nil {
+		return nil
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.f == nil {
+		return nil
+	}
+	err := a.f.Close()
+	a.f = nil
+	return err
+}
+
+func auditResult(err error) (result string, msg string) {
+	if _, ok := err.(*ssh.PartialSuccessError); ok {
+		return AuditResultPartial, ""
+	}
+	if err != nil {
+		return AuditResultFailure, err.Error()
+	}
+	return AuditResultSuccess, ""
+}
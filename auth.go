@@ -0,0 +1,162 @@
+package main
+
+import (
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/crypto/ssh"
+	"strings"
+)
+
+const (
+	AuthBackendHtpasswd = "htpasswd"
+	AuthBackendLDAP     = "ldap"
+	AuthBackendWebhook  = "webhook"
+)
+
+var (
+	// ErrUnknownUser 后端中没有该用户或不支持该认证方式，交给下一个后端处理
+	ErrUnknownUser   = errors.New("unknown user")
+	ErrWrongPassword = errors.New("wrong password")
+	ErrKeyNotAllowed = errors.New("public key not allowed")
+)
+
+type (
+	// AuthBackendConfig 认证后端配置，按 Type 使用不同的字段
+	AuthBackendConfig struct {
+		Type               string `json:"Type"`               // htpasswd、ldap 或 webhook
+		File               string `json:"File"`               // htpasswd 文件路径
+		URL                string `json:"URL"`                // ldap://host:389、ldaps://host:636 或 webhook 地址
+		BindDN             string `json:"BindDN"`             // LDAP 绑定 DN 模板，%s 替换为用户名，如 uid=%s,ou=people,dc=example,dc=com
+		Timeout            int    `json:"Timeout"`            // 超时秒数，默认 5
+		InsecureSkipVerify bool   `json:"InsecureSkipVerify"` // 不校验 ldaps/https 证书
+	}
+
+	// AuthRequest 认证请求的连接信息
+	AuthRequest struct {
+		User       string
+		RemoteAddr string
+	}
+
+	// AuthResult 认证通过后后端返回的账号属性
+	AuthResult struct {
+		Attributes map[string]string
+	}
+
+	// Authenticator 认证后端
+	Authenticator interface {
+		Name() string
+		// CheckPassword 校验通过返回结果，用户不存在返回 ErrUnknownUser
+		CheckPassword(req AuthRequest, password string) (*AuthResult, error)
+		// CheckPublicKey 不支持公钥认证的后端返回 ErrUnknownUser
+		CheckPublicKey(req AuthRequest, key ssh.PublicKey) (*AuthResult, error)
+	}
+
+	// AuthChain 依次询问各个后端，由第一个认识该用户的后端给出结果
+	AuthChain []Authenticator
+
+	// ConfigAuthenticator 校验配置文件中的账号
+	ConfigAuthenticator struct {
+		cfg *Config
+	}
+)
+
+// NewAuthChain 配置文件中的账号最先校验，然后按顺序询问 AuthBackends
+func NewAuthChain(cfg *Config) (AuthChain, error) {
+	chain := AuthChain{NewConfigAuthenticator(cfg)}
+	for _, backend := range cfg.AuthBackends {
+		a, err := NewAuthenticator(backend)
+		if err != nil {
+			return chain, err
+		}
+		chain = append(chain, a)
+	}
+	return chain, nil
+}
+
+func NewAuthenticator(cfg AuthBackendConfig) (Authenticator, error) {
+	if cfg.Timeout == 0 {
+		cfg.Timeout = 5
+	}
+	switch cfg.Type {
+	case AuthBackendHtpasswd:
+		return NewHtpasswdAuthenticator(cfg.File), nil
+	case AuthBackendLDAP:
+		return NewLDAPAuthenticator(cfg)
+	case AuthBackendWebhook:
+		return NewWebhookAuthenticator(cfg)
+	default:
+		return nil, errors.New(fmt.Sprintf("unknown auth backend type %q", cfg.Type))
+	}
+}
+
+func NewConfigAuthenticator(cfg *Config) *ConfigAuthenticator {
+	return &ConfigAuthenticator{cfg: cfg}
+}
+
+func (a *ConfigAuthenticator) Name() string {
+	return "config"
+}
+
+func (a *ConfigAuthenticator) CheckPassword(req AuthRequest, password string) (*AuthResult, error) {
+	account := a.cfg.LookupAccount(req.User)
+	if account == nil {
+		return nil, ErrUnknownUser
+	}
+	if account.Password == "" || !checkPasswordHash(account.Password, password) {
+		return nil, ErrWrongPassword
+	}
+	return &AuthResult{}, nil
+}
+
+func (a *ConfigAuthenticator) CheckPublicKey(req AuthRequest, key ssh.PublicKey) (*AuthResult, error) {
+	if a.cfg.LookupAccount(req.User) == nil {
+		return nil, ErrUnknownUser
+	}
+	if !a.cfg.IsAuthorizedKey(key) {
+		return nil, ErrKeyNotAllowed
+	}
+	return &AuthResult{}, nil
+}
+
+// CheckPassword 返回给出结果的后端名称
+func (c AuthChain) CheckPassword(req AuthRequest, password string) (string, *AuthResult, error) {
+	for _, a := range c {
+		result, err := a.CheckPassword(req, password)
+		if errors.Is(err, ErrUnknownUser) {
+			continue
+		}
+		return a.Name(), result, err
+	}
+	return "", nil, ErrUnknownUser
+}
+
+// CheckPublicKey 返回给出结果的后端名称
+func (c AuthChain) CheckPublicKey(req AuthRequest, key ssh.PublicKey) (string, *AuthResult, error) {
+	for _, a := range c {
+		result, err := a.CheckPublicKey(req, key)
+		if errors.Is(err, ErrUnknownUser) {
+			continue
+		}
+		return a.Name(), result, err
+	}
+	return "", nil, ErrUnknownUser
+}
+
+// Close 释放后端持有的连接，配置重新加载替换后调用
+func (c AuthChain) Close() {
+	for _, a := range c {
+		if closer, ok := a.(interface{ Close() }); ok {
+			closer.Close()
+		}
+	}
+}
+
+// checkPasswordHash 支持 bcrypt 哈希（$2a$/$2b$/$2y$ 开头）和明文密码
+func checkPasswordHash(stored, password string) bool {
+	if strings.HasPrefix(stored, "$2a$") || strings.HasPrefix(stored, "$2b$") || strings.HasPrefix(stored, "$2y$") {
+		return bcrypt.CompareHashAndPassword([]byte(stored), []byte(password)) == nil
+	}
+	return subtle.ConstantTimeCompare([]byte(stored), []byte(password)) == 1
+}
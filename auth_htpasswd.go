@@ -0,0 +1,145 @@
+package main
+
+import (
+	"bufio"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base64"
+	"golang.org/x/crypto/ssh"
+	"os"
+	"strings"
+)
+
+type (
+	// HtpasswdAuthenticator 使用 Apache htpasswd 格式的文件校验密码，
+	// 支持 bcrypt、apr1 MD5 和 {SHA}，每次认证时重新读取文件
+	HtpasswdAuthenticator struct {
+		file string
+	}
+)
+
+func NewHtpasswdAuthenticator(file string) *HtpasswdAuthenticator {
+	return &HtpasswdAuthenticator{file: file}
+}
+
+func (a *HtpasswdAuthenticator) Name() string {
+	return AuthBackendHtpasswd
+}
+
+func (a *HtpasswdAuthenticator) CheckPassword(req AuthRequest, password string) (*AuthResult, error) {
+	hash, err := a.lookup(req.User)
+	if err != nil {
+		return nil, err
+	}
+	if !checkHtpasswdHash(hash, password) {
+		return nil, ErrWrongPassword
+	}
+	return &AuthResult{}, nil
+}
+
+func (a *HtpasswdAuthenticator) CheckPublicKey(req AuthRequest, key ssh.PublicKey) (*AuthResult, error) {
+	return nil, ErrUnknownUser
+}
+
+func (a *HtpasswdAuthenticator) lookup(user string) (string, error) {
+	f, err := os.Open(a.file)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		name, hash, ok := strings.Cut(line, ":")
+		if ok && name == user {
+			return hash, nil
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return "", err
+	}
+	return "", ErrUnknownUser
+}
+
+func checkHtpasswdHash(hash, password string) bool {
+	switch {
+	case strings.HasPrefix(hash, "$apr1$"):
+		salt, _, _ := strings.Cut(strings.TrimPrefix(hash, "$apr1$"), "$")
+		return subtle.ConstantTimeCompare([]byte(apr1Crypt(password, salt)), []byte(hash)) == 1
+	case strings.HasPrefix(hash, "{SHA}"):
+		sum := sha1.Sum([]byte(password))
+		expect := "{SHA}" + base64.StdEncoding.EncodeToString(sum[:])
+		return subtle.ConstantTimeCompare([]byte(expect), []byte(hash)) == 1
+	case strings.HasPrefix(hash, "$2a$"), strings.HasPrefix(hash, "$2b$"), strings.HasPrefix(hash, "$2y$"):
+		return checkPasswordHash(hash, password)
+	default:
+		// crypt(3) 和明文格式不支持
+		return false
+	}
+}
+
+// apr1Crypt Apache 的 MD5 crypt 变体，magic 为 $apr1$
+func apr1Crypt(password, salt string) string {
+	const magic = "$apr1$"
+	const itoa64 = "./0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+	if len(salt) > 8 {
+		salt = salt[:8]
+	}
+	pw := []byte(password)
+
+	alt := md5.Sum([]byte(password + salt + password))
+	ctx := md5.New()
+	ctx.Write([]byte(password + magic + salt))
+	for i := len(pw); i > 0; i -= 16 {
+		if i > 16 {
+			ctx.Write(alt[:])
+		} else {
+			ctx.Write(alt[:i])
+		}
+	}
+	for i := len(pw); i > 0; i >>= 1 {
+		if i&1 != 0 {
+			ctx.Write([]byte{0})
+		} else {
+			ctx.Write(pw[:1])
+		}
+	}
+	final := ctx.Sum(nil)
+	for i := 0; i < 1000; i++ {
+		round := md5.New()
+		if i&1 != 0 {
+			round.Write(pw)
+		} else {
+			round.Write(final)
+		}
+		if i%3 != 0 {
+			round.Write([]byte(salt))
+		}
+		if i%7 != 0 {
+			round.Write(pw)
+		}
+		if i&1 != 0 {
+			round.Write(final)
+		} else {
+			round.Write(pw)
+		}
+		final = round.Sum(nil)
+	}
+
+	out := make([]byte, 0, 22)
+	to64 := func(v uint32, n int) {
+		for ; n > 0; n-- {
+			out = append(out, itoa64[v&0x3f])
+			v >>= 6
+		}
+	}
+	for _, idx := range [][3]int{{0, 6, 12}, {1, 7, 13}, {2, 8, 14}, {3, 9, 15}, {4, 10, 5}} {
+		to64(uint32(final[idx[0]])<<16|uint32(final[idx[1]])<<8|uint32(final[idx[2]]), 4)
+	}
+	to64(uint32(final[11]), 2)
+	return magic + salt + "$" + string(out)
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// 固定的测试向量：apr1 来自 Apache 文档（htpasswd -m）和 openssl passwd -apr1，bcrypt 来自 crypt_blowfish 的测试集
+const (
+	htpasswdApr1   = "$apr1$r31.....$HqJZimcKQFAMYayBlzkrA/"                        // myPassword
+	htpasswdSHA    = "{SHA}W6ph5Mm5Pz8GgiULbPgzG37mj9g="                            // password
+	htpasswdBcrypt = "$2a$05$CCCCCCCCCCCCCCCCCCCCC.E5YPO9kmyuRGyh0XouQYb4YMJKvyOeW" // U*U
+)
+
+func TestApr1Crypt(t *testing.T) {
+	tests := []struct {
+		password, salt, out string
+	}{
+		{"myPassword", "r31.....", htpasswdApr1},
+		{"password", "saltsalt", "$apr1$saltsalt$yAAkm4libquA.ZWLHbSBq/"},
+		{"p@ss word", "abc", "$apr1$abc$Q90.kW6FW3iF.V18kJ7M71"},
+	}
+	for _, tt := range tests {
+		if got := apr1Crypt(tt.password, tt.salt); got != tt.out {
+			t.Errorf("apr1Crypt(%q, %q) = %s, want %s", tt.password, tt.salt, got, tt.out)
+		}
+	}
+}
+
+func TestCheckHtpasswdHash(t *testing.T) {
+	tests := []struct {
+		name     string
+		hash     string
+		password string
+		ok       bool
+	}{
+		{"apr1", htpasswdApr1, "myPassword", true},
+		{"wrong apr1", htpasswdApr1, "mypassword", false},
+		{"sha", htpasswdSHA, "password", true},
+		{"wrong sha", htpasswdSHA, "Password", false},
+		{"bcrypt 2a", htpasswdBcrypt, "U*U", true},
+		{"bcrypt 2y", "$2y$" + htpasswdBcrypt[4:], "U*U", true},
+		{"wrong bcrypt", htpasswdBcrypt, "U*U*", false},
+		{"crypt", "rqXexS6ZhobKA", "password", false},
+		{"plain text", "password", "password", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if ok := checkHtpasswdHash(tt.hash, tt.password); ok != tt.ok {
+				t.Fatalf("checkHtpasswdHash(%q, %q) = %v, want %v", tt.hash, tt.password, ok, tt.ok)
+			}
+		})
+	}
+}
+
+func TestHtpasswdAuthenticatorCheckPassword(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "htpasswd")
+	data := "# users\n\nalice:" + htpasswdApr1 + "\nbob:" + htpasswdSHA + "\n"
+	if err := os.WriteFile(file, []byte(data), 0600); err != nil {
+		t.Fatal(err)
+	}
+	a := NewHtpasswdAuthenticator(file)
+	tests := []struct {
+		name     string
+		user     string
+		password string
+		err      error
+	}{
+		{"apr1 user", "alice", "myPassword", nil},
+		{"sha user", "bob", "password", nil},
+		{"wrong password", "alice", "password", ErrWrongPassword},
+		{"unknown user", "carol", "password", ErrUnknownUser},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := a.CheckPassword(AuthRequest{User: tt.user}, tt.password); !errors.Is(err, tt.err) {
+				t.Fatalf("err = %v, want %v", err, tt.err)
+			}
+		})
+	}
+}
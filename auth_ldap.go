@@ -0,0 +1,257 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"golang.org/x/crypto/ssh"
+	"io"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// LDAP 协议中用到的 BER 标签和结果码，见 RFC 4511
+const (
+	berTagInteger     = 0x02
+	berTagOctetString = 0x04
+	berTagEnumerated  = 0x0a
+	berTagSequence    = 0x30
+	ldapTagBindReq    = 0x60
+	ldapTagBindResp   = 0x61
+	ldapTagUnbindReq  = 0x42
+	ldapTagSimpleAuth = 0x80
+
+	ldapResultSuccess            = 0
+	ldapResultNoSuchObject       = 32
+	ldapResultInvalidCredentials = 49
+)
+
+type (
+	// LDAPAuthenticator 使用 LDAP simple bind 校验密码
+	LDAPAuthenticator struct {
+		addr      string
+		useTLS    bool
+		bindDN    string
+		timeout   time.Duration
+		tlsConfig *tls.Config
+	}
+)
+
+func NewLDAPAuthenticator(cfg AuthBackendConfig) (*LDAPAuthenticator, error) {
+	u, err := url.Parse(cfg.URL)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("parse ldap url %s err:%s", cfg.URL, err.Error()))
+	}
+	a := &LDAPAuthenticator{
+		addr:    u.Host,
+		bindDN:  cfg.BindDN,
+		timeout: time.Duration(cfg.Timeout) * time.Second,
+	}
+	switch u.Scheme {
+	case "ldap":
+		if u.Port() == "" {
+			a.addr = net.JoinHostPort(u.Hostname(), "389")
+		}
+	case "ldaps":
+		if u.Port() == "" {
+			a.addr = net.JoinHostPort(u.Hostname(), "636")
+		}
+		a.useTLS = true
+		a.tlsConfig = &tls.Config{ServerName: u.Hostname(), InsecureSkipVerify: cfg.InsecureSkipVerify}
+	default:
+		return nil, errors.New(fmt.Sprintf("unsupported ldap url %s", cfg.URL))
+	}
+	if !strings.Contains(a.bindDN, "%s") {
+		return nil, errors.New("ldap BindDN must contain %s")
+	}
+	return a, nil
+}
+
+func (a *LDAPAuthenticator) Name() string {
+	return AuthBackendLDAP
+}
+
+func (a *LDAPAuthenticator) CheckPassword(req AuthRequest, password string) (*AuthResult, error) {
+	// 空密码在 LDAP 中是匿名绑定，总是成功，必须拒绝
+	if password == "" {
+		return nil, ErrWrongPassword
+	}
+	dn := fmt.Sprintf(a.bindDN, escapeDN(req.User))
+	code, msg, err := a.bind(dn, password)
+	if err != nil {
+		return nil, err
+	}
+	switch code {
+	case ldapResultSuccess:
+		return &AuthResult{Attributes: map[string]string{"dn": dn}}, nil
+	case ldapResultNoSuchObject:
+		return nil, ErrUnknownUser
+	case ldapResultInvalidCredentials:
+		return nil, ErrWrongPassword
+	default:
+		return nil, errors.New(fmt.Sprintf("ldap bind result %d: %s", code, msg))
+	}
+}
+
+func (a *LDAPAuthenticator) CheckPublicKey(req AuthRequest, key ssh.PublicKey) (*AuthResult, error) {
+	return nil, ErrUnknownUser
+}
+
+// bind 发送 BindRequest 并返回结果码和服务端的诊断信息
+func (a *LDAPAuthenticator) bind(dn, password string) (int, string, error) {
+	dialer := &net.Dialer{Timeout: a.timeout}
+	var conn net.Conn
+	var err error
+	if a.useTLS {
+		conn, err = tls.DialWithDialer(dialer, "tcp", a.addr, a.tlsConfig)
+	} else {
+		conn, err = dialer.Dial("tcp", a.addr)
+	}
+	if err != nil {
+		return 0, "", err
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(a.timeout))
+
+	bindReq := berTLV(ldapTagBindReq, concatBytes(
+		berTLV(berTagInteger, []byte{3}),
+		berTLV(berTagOctetString, []byte(dn)),
+		berTLV(ldapTagSimpleAuth, []byte(password)),
+	))
+	msg := berTLV(berTagSequence, concatBytes(berTLV(berTagInteger, []byte{1}), bindReq))
+	if _, err := conn.Write(msg); err != nil {
+		return 0, "", err
+	}
+
+	tag, body, err := readBER(conn)
+	if err != nil {
+		return 0, "", err
+	}
+	if tag != berTagSequence {
+		return 0, "", errors.New("invalid ldap response")
+	}
+	// messageID
+	_, _, body, err = splitBER(body)
+	if err != nil {
+		return 0, "", err
+	}
+	tag, resp, _, err := splitBER(body)
+	if err != nil {
+		return 0, "", err
+	}
+	if tag != ldapTagBindResp {
+		return 0, "", errors.New(fmt.Sprintf("unexpected ldap response tag 0x%x", tag))
+	}
+	tag, code, resp, err := splitBER(resp)
+	if err != nil || tag != berTagEnumerated || len(code) == 0 {
+		return 0, "", errors.New("invalid ldap bind response")
+	}
+	result := 0
+	for _, b := range code {
+		result = result<<8 | int(b)
+	}
+	var diagnostic []byte
+	// matchedDN, diagnosticMessage
+	if _, _, resp, err = splitBER(resp); err == nil {
+		_, diagnostic, _, _ = splitBER(resp)
+	}
+	_, _ = conn.Write(berTLV(berTagSequence, concatBytes(berTLV(berTagInteger, []byte{2}), berTLV(ldapTagUnbindReq, nil))))
+	return result, string(diagnostic), nil
+}
+
+func berTLV(tag byte, value []byte) []byte {
+	out := []byte{tag}
+	n := len(value)
+	switch {
+	case n < 0x80:
+		out = append(out, byte(n))
+	case n < 0x100:
+		out = append(out, 0x81, byte(n))
+	case n < 0x10000:
+		out = append(out, 0x82, byte(n>>8), byte(n))
+	default:
+		out = append(out, 0x83, byte(n>>16), byte(n>>8), byte(n))
+	}
+	return append(out, value...)
+}
+
+func concatBytes(parts ...[]byte) []byte {
+	out := make([]byte, 0)
+	for _, p := range parts {
+		out = append(out, p...)
+	}
+	return out
+}
+
+// readBER 从连接中读取一个完整的 TLV
+func readBER(r io.Reader) (byte, []byte, error) {
+	head := make([]byte, 2)
+	if _, err := io.ReadFull(r, head); err != nil {
+		return 0, nil, err
+	}
+	length := int(head[1])
+	if length&0x80 != 0 {
+		n := length & 0x7f
+		if n == 0 || n > 3 {
+			return 0, nil, errors.New("invalid ber length")
+		}
+		buf := make([]byte, n)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return 0, nil, err
+		}
+		length = 0
+		for _, b := range buf {
+			length = length<<8 | int(b)
+		}
+	}
+	body := make([]byte, length)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return 0, nil, err
+	}
+	return head[0], body, nil
+}
+
+// splitBER 拆出 data 开头的一个 TLV，返回标签、内容和剩余的数据
+func splitBER(data []byte) (byte, []byte, []byte, error) {
+	if len(data) < 2 {
+		return 0, nil, nil, io.ErrUnexpectedEOF
+	}
+	tag, length, offset := data[0], int(data[1]), 2
+	if length&0x80 != 0 {
+		n := length & 0x7f
+		if n == 0 || n > 3 || len(data) < 2+n {
+			return 0, nil, nil, errors.New("invalid ber length")
+		}
+		length = 0
+		for _, b := range data[2 : 2+n] {
+			length = length<<8 | int(b)
+		}
+		offset += n
+	}
+	if len(data) < offset+length {
+		return 0, nil, nil, io.ErrUnexpectedEOF
+	}
+	return tag, data[offset : offset+length], data[offset+length:], nil
+}
+
+// escapeDN 按 RFC 4514 转义 DN 中的属性值
+func escapeDN(value string) string {
+	var b strings.Builder
+	for i := 0; i < len(value); i++ {
+		c := value[i]
+		switch {
+		case strings.IndexByte(",+\"\\<>;=", c) >= 0,
+			(c == ' ' || c == '#') && i == 0,
+			c == ' ' && i == len(value)-1:
+			b.WriteByte('\\')
+			b.WriteByte(c)
+		case c == 0:
+			b.WriteString("\\00")
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
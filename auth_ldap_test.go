@@ -0,0 +1,139 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"sync/atomic"
+	"testing"
+)
+
+// ldapStub 只实现 simple bind 的 LDAP 服务端，按 DN 返回结果码
+type ldapStub struct {
+	l     net.Listener
+	binds int32
+	// dn -> 密码，不在其中的 DN 返回 noSuchObject
+	users map[string]string
+	// 对该 DN 的绑定总是返回的结果码
+	codes map[string]int
+}
+
+func newLDAPStub(t *testing.T) *ldapStub {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &ldapStub{l: l, users: map[string]string{}, codes: map[string]int{}}
+	t.Cleanup(func() { _ = l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+	return s
+}
+
+func (s *ldapStub) serve(conn net.Conn) {
+	defer conn.Close()
+	_, body, err := readBER(conn)
+	if err != nil {
+		return
+	}
+	atomic.AddInt32(&s.binds, 1)
+	// messageID, BindRequest{version, name, simple}
+	_, _, body, _ = splitBER(body)
+	_, req, _, _ := splitBER(body)
+	_, _, req, _ = splitBER(req)
+	_, dn, req, _ := splitBER(req)
+	_, password, _, _ := splitBER(req)
+	code := ldapResultSuccess
+	if c, ok := s.codes[string(dn)]; ok {
+		code = c
+	} else if p, ok := s.users[string(dn)]; !ok {
+		code = ldapResultNoSuchObject
+	} else if p != string(password) {
+		code = ldapResultInvalidCredentials
+	}
+	resp := berTLV(ldapTagBindResp, concatBytes(
+		berTLV(berTagEnumerated, []byte{byte(code)}),
+		berTLV(berTagOctetString, nil),
+		berTLV(berTagOctetString, []byte("stub")),
+	))
+	_, _ = conn.Write(berTLV(berTagSequence, concatBytes(berTLV(berTagInteger, []byte{1}), resp)))
+}
+
+func TestLDAPAuthenticatorCheckPassword(t *testing.T) {
+	stub := newLDAPStub(t)
+	stub.users["uid=alice,dc=example"] = "s3cret"
+	stub.users[`uid=a\,b,dc=example`] = "comma"
+	stub.codes["uid=busy,dc=example"] = 51
+	a, err := NewLDAPAuthenticator(AuthBackendConfig{
+		URL:     "ldap://" + stub.l.Addr().String(),
+		BindDN:  "uid=%s,dc=example",
+		Timeout: 5,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name     string
+		user     string
+		password string
+		err      error
+	}{
+		{"success", "alice", "s3cret", nil},
+		{"invalid credentials", "alice", "wrong", ErrWrongPassword},
+		{"no such object", "bob", "s3cret", ErrUnknownUser},
+		{"escaped user", "a,b", "comma", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result, err := a.CheckPassword(AuthRequest{User: tt.user}, tt.password)
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("err = %v, want %v", err, tt.err)
+			}
+			if err == nil && result.Attributes["dn"] == "" {
+				t.Fatal("dn attribute is empty")
+			}
+		})
+	}
+
+	t.Run("other result code", func(t *testing.T) {
+		_, err := a.CheckPassword(AuthRequest{User: "busy"}, "s3cret")
+		if err == nil || errors.Is(err, ErrWrongPassword) || errors.Is(err, ErrUnknownUser) {
+			t.Fatalf("err = %v, want ldap bind result error", err)
+		}
+	})
+
+	t.Run("empty password", func(t *testing.T) {
+		before := atomic.LoadInt32(&stub.binds)
+		if _, err := a.CheckPassword(AuthRequest{User: "alice"}, ""); !errors.Is(err, ErrWrongPassword) {
+			t.Fatalf("err = %v, want %v", err, ErrWrongPassword)
+		}
+		if atomic.LoadInt32(&stub.binds) != before {
+			t.Fatal("empty password must not be sent to the ldap server")
+		}
+	})
+}
+
+func TestEscapeDN(t *testing.T) {
+	tests := []struct {
+		in, out string
+	}{
+		{"alice", "alice"},
+		{"a,b", `a\,b`},
+		{`a+b"c\d<e>f;g=h`, `a\+b\"c\\d\<e\>f\;g\=h`},
+		{" alice ", `\ alice\ `},
+		{"#alice", `\#alice`},
+		{"al#ice", "al#ice"},
+		{"a\x00b", `a\00b`},
+	}
+	for _, tt := range tests {
+		if got := escapeDN(tt.in); got != tt.out {
+			t.Errorf("escapeDN(%q) = %q, want %q", tt.in, got, tt.out)
+		}
+	}
+}
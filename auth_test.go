@@ -0,0 +1,107 @@
+package main
+
+import (
+	"errors"
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/crypto/ssh"
+	"testing"
+)
+
+// stubAuthenticator 按用户名返回固定结果，记录被调用的次数
+type stubAuthenticator struct {
+	name  string
+	users map[string]error
+	calls int
+}
+
+func (a *stubAuthenticator) Name() string {
+	return a.name
+}
+
+func (a *stubAuthenticator) CheckPassword(req AuthRequest, password string) (*AuthResult, error) {
+	a.calls++
+	err, ok := a.users[req.User]
+	if !ok {
+		return nil, ErrUnknownUser
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &AuthResult{}, nil
+}
+
+func (a *stubAuthenticator) CheckPublicKey(req AuthRequest, key ssh.PublicKey) (*AuthResult, error) {
+	return nil, ErrUnknownUser
+}
+
+func TestConfigAuthenticatorCheckPassword(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("s3cret"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := &Config{
+		Account: Account{Username: "tools", Password: "tools"},
+		Accounts: []Account{
+			{Username: "hashed", Password: string(hash)},
+			{Username: "nopass"},
+		},
+	}
+	a := NewConfigAuthenticator(cfg)
+	tests := []struct {
+		name     string
+		user     string
+		password string
+		err      error
+	}{
+		{"plain password", "tools", "tools", nil},
+		{"wrong plain password", "tools", "wrong", ErrWrongPassword},
+		{"bcrypt password", "hashed", "s3cret", nil},
+		{"wrong bcrypt password", "hashed", "wrong", ErrWrongPassword},
+		{"hash used as password", "hashed", string(hash), ErrWrongPassword},
+		{"empty password", "tools", "", ErrWrongPassword},
+		{"account without password", "nopass", "", ErrWrongPassword},
+		{"unknown user", "nobody", "tools", ErrUnknownUser},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result, err := a.CheckPassword(AuthRequest{User: tt.user}, tt.password)
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("err = %v, want %v", err, tt.err)
+			}
+			if err == nil && result == nil {
+				t.Fatal("result is nil")
+			}
+		})
+	}
+}
+
+func TestAuthChainCheckPassword(t *testing.T) {
+	tests := []struct {
+		name    string
+		user    string
+		backend string
+		err     error
+		calls   []int
+	}{
+		{"first backend accepts", "alice", "first", nil, []int{1, 0}},
+		{"unknown user falls through", "bob", "second", nil, []int{1, 1}},
+		{"wrong password stops the chain", "carol", "first", ErrWrongPassword, []int{1, 0}},
+		{"unknown in every backend", "dave", "", ErrUnknownUser, []int{1, 1}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			first := &stubAuthenticator{name: "first", users: map[string]error{"alice": nil, "carol": ErrWrongPassword}}
+			second := &stubAuthenticator{name: "second", users: map[string]error{"bob": nil, "carol": nil}}
+			backend, _, err := AuthChain{first, second}.CheckPassword(AuthRequest{User: tt.user}, "password")
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("err = %v, want %v", err, tt.err)
+			}
+			if backend != tt.backend {
+				t.Fatalf("backend = %q, want %q", backend, tt.backend)
+			}
+			if first.calls != tt.calls[0] || second.calls != tt.calls[1] {
+				t.Fatalf("calls = [%d %d], want %v", first.calls, second.calls, tt.calls)
+			}
+		})
+	}
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"golang.org/x/crypto/ssh"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+type (
+	// WebhookAuthenticator 将认证请求 POST 到 HTTP 接口，由接口决定是否允许。
+	// 接口返回 404 表示不认识该用户，交给下一个后端
+	WebhookAuthenticator struct {
+		url    string
+		client *http.Client
+	}
+	webhookRequest struct {
+		User        string `json:"User"`
+		RemoteAddr  string `json:"RemoteAddr"`
+		Method      string `json:"Method"`
+		Password    string `json:"Password,omitempty"`
+		Fingerprint string `json:"Fingerprint,omitempty"`
+		PublicKey   string `json:"PublicKey,omitempty"` // authorized_keys 格式
+	}
+	webhookResponse struct {
+		Allow      bool              `json:"Allow"`
+		Attributes map[string]string `json:"Attributes"` // 账号属性，会作为环境变量传给会话
+	}
+)
+
+func NewWebhookAuthenticator(cfg AuthBackendConfig) (*WebhookAuthenticator, error) {
+	if !strings.HasPrefix(cfg.URL, "http://") && !strings.HasPrefix(cfg.URL, "https://") {
+		return nil, errors.New(fmt.Sprintf("unsupported webhook url %s", cfg.URL))
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = &tls.Config{InsecureSkipVerify: cfg.InsecureSkipVerify}
+	return &WebhookAuthenticator{
+		url: cfg.URL,
+		client: &http.Client{
+			Transport: transport,
+			Timeout:   time.Duration(cfg.Timeout) * time.Second,
+		},
+	}, nil
+}
+
+func (a *WebhookAuthenticator) Name() string {
+	return AuthBackendWebhook
+}
+
+// Close 关闭空闲的 HTTP 连接
+func (a *WebhookAuthenticator) Close() {
+	a.client.CloseIdleConnections()
+}
+
+func (a *WebhookAuthenticator) CheckPassword(req AuthRequest, password string) (*AuthResult, error) {
+	return a.call(webhookRequest{
+		User:       req.User,
+		RemoteAddr: req.RemoteAddr,
+		Method:     AuthMethodPassword,
+		Password:   password,
+	}, ErrWrongPassword)
+}
+
+func (a *WebhookAuthenticator) CheckPublicKey(req AuthRequest, key ssh.PublicKey) (*AuthResult, error) {
+	return a.call(webhookRequest{
+		User:        req.User,
+		RemoteAddr:  req.RemoteAddr,
+		Method:      AuthMethodPublicKey,
+		Fingerprint: ssh.FingerprintSHA256(key),
+		PublicKey:   strings.TrimSpace(string(ssh.MarshalAuthorizedKey(key))),
+	}, ErrKeyNotAllowed)
+}
+
+func (a *WebhookAuthenticator) call(req webhookRequest, deny error) (*AuthResult, error) {
+	data, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := a.client.Post(a.url, "application/json", bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, ErrUnknownUser
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.New(fmt.Sprintf("webhook returned %s", resp.Status))
+	}
+	var result webhookResponse
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&result); err != nil {
+		return nil, errors.New(fmt.Sprintf("decode webhook response err:%s", err.Error()))
+	}
+	if !result.Allow {
+		return nil, deny
+	}
+	return &AuthResult{Attributes: result.Attributes}, nil
+}
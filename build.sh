@@ -8,5 +8,39 @@ GOOS=windows GOARCH=arm go build -ldflags "-s -w" -o ssh_toolkits_arm.exe
 
 # 执行命令
 
-nohup ssh_toolkits -port 4400 -username tools -password tools &
+ssh_toolkits -daemon -port 4400 -username tools -password tools
 
+# 查看状态 / 停止
+ssh_toolkits status
+ssh_toolkits stop
+
+# 配置优先级：默认值 < ssh_toolkits_cfg.json < SSH_TOOLKITS_* 环境变量 < 命令行参数
+# 查看最终生效的配置
+ssh_toolkits -print-config
+
+
+# 为账号生成 TOTP 密钥（默认为主账号），写入该账号的 TOTPSecret 后登录需要输入验证码
+ssh_toolkits totp-enroll tools
+
+# 开启 X11 转发（配置文件中 X11.Enable 或环境变量），客户端使用 ssh -X 连接
+SSH_TOOLKITS_X11_FORWARDING=true ssh_toolkits -port 4400
+
+# 认证前提示和登录提示（也可在配置文件 Login 中设置），Last login 记录在 Login.LastLogFile
+SSH_TOOLKITS_BANNER_FILE=/etc/issue.net SSH_TOOLKITS_MOTD_FILE=/etc/motd ssh_toolkits -port 4400
+
+# 空闲超时、最长连接时间（秒，负数不限制）和 keepalive 间隔，账号中的 IdleTimeout/MaxTimeout 优先
+SSH_TOOLKITS_IDLE_TIMEOUT=1800 SSH_TOOLKITS_MAX_TIMEOUT=-1 SSH_TOOLKITS_CLIENT_ALIVE_INTERVAL=60 ssh_toolkits -port 4400
+
+# 连接和会话数量限制（0 表示不限制），MaxStartups 与 OpenSSH 相同为 start:rate:full
+SSH_TOOLKITS_MAX_CONNECTIONS=200 SSH_TOOLKITS_MAX_SESSIONS=10 SSH_TOOLKITS_MAX_STARTUPS=10:30:100 ssh_toolkits -port 4400
+
+# Linux 上限制会话中命令的资源（配置文件 Resources / Account.Resources），
+# MemoryMax、CPUMax 需要 cgroup v2 并开启 memory、cpu 控制器
+SSH_TOOLKITS_CGROUP_ROOT=/sys/fs/cgroup/ssh_toolkits ssh_toolkits -port 4400
+
+# exec 命令的最长运行时间（秒）和输出字节数上限，超出后终止整个进程组；
+# 配置 Exec.AllowClientTimeout 后客户端可以用 ssh -o SetEnv=SSH_TOOLKITS_TIMEOUT=30 host cmd 设置更短的超时
+SSH_TOOLKITS_EXEC_TIMEOUT=600 SSH_TOOLKITS_EXEC_MAX_OUTPUT=10485760 ssh_toolkits -port 4400
+
+# 允许 ssh -L 本地端口转发，证书需要 permit-port-forwarding，账号可以用 DisablePortForwarding 禁止
+SSH_TOOLKITS_TCP_FORWARDING=true ssh_toolkits -port 4400
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	sshd "github.com/gliderlabs/ssh"
+	"golang.org/x/crypto/ssh"
+)
+
+// OpenSSH 证书中的 critical options 和 extensions
+const (
+	certOptionForceCommand       = "force-command"
+	certOptionSourceAddress      = "source-address"
+	certExtPermitPty             = "permit-pty"
+	certExtPermitPortForwarding  = "permit-port-forwarding"
+	certExtPermitAgentForwarding = "permit-agent-forwarding"
+
+	// envOriginalCommand 执行 force-command 时保存客户端原本请求的命令
+	envOriginalCommand = "SSH_ORIGINAL_COMMAND"
+)
+
+// IsUserAuthority 判断公钥是否为受信任的用户 CA
+func (c *Config) IsUserAuthority(auth ssh.PublicKey) bool {
+	for _, line := range c.TrustedUserCAKeys {
+		pk, _, _, _, err := ssh.ParseAuthorizedKey([]byte(line))
+		if err != nil {
+			continue
+		}
+		if bytes.Equal(auth.Marshal(), pk.Marshal()) {
+			return true
+		}
+	}
+	return false
+}
+
+// CheckUserCert 校验用户证书的签发 CA、有效期、principals 和 critical options，
+// principals 必须包含登录的账号名，source-address 由 x/crypto 根据返回的 Permissions 校验，
+// 包括需要继续输入 TOTP 验证码的部分成功
+func (c *Config) CheckUserCert(conn ssh.ConnMetadata, cert *ssh.Certificate) (*ssh.Permissions, error) {
+	if len(c.TrustedUserCAKeys) == 0 {
+		return nil, errors.New("no trusted user ca keys")
+	}
+	if c.LookupAccount(conn.User()) == nil {
+		return nil, errors.New(fmt.Sprintf("unknown account %s", conn.User()))
+	}
+	if len(cert.ValidPrincipals) == 0 {
+		return nil, errors.New("certificate has no principals")
+	}
+	checker := &ssh.CertChecker{
+		IsUserAuthority:          c.IsUserAuthority,
+		SupportedCriticalOptions: []string{certOptionForceCommand, certOptionSourceAddress},
+	}
+	perms, err := checker.Authenticate(conn, cert)
+	if err != nil {
+		return nil, err
+	}
+	// 复制一份，Extensions 始终不为 nil，用于在会话中区分证书登录
+	result := &ssh.Permissions{
+		CriticalOptions: make(map[string]string, len(perms.CriticalOptions)),
+		Extensions:      make(map[string]string, len(perms.Extensions)),
+	}
+	for k, v := range perms.CriticalOptions {
+		result.CriticalOptions[k] = v
+	}
+	for k, v := range perms.Extensions {
+		result.Extensions[k] = v
+	}
+	return result, nil
+}
+
+// certPermissions 返回证书登录时证书中的权限，其他方式登录时返回 nil
+func certPermissions(ctx sshd.Context) *ssh.Permissions {
+	conn, ok := ctx.Value(sshd.ContextKeyConn).(*ssh.ServerConn)
+	if !ok || conn.Permissions == nil || conn.Permissions.Extensions == nil {
+		return nil
+	}
+	return conn.Permissions
+}
+
+// certPermits 证书登录时判断证书是否包含指定的 extension，其他方式登录不做限制
+func certPermits(ctx sshd.Context, ext string) bool {
+	perms := certPermissions(ctx)
+	if perms == nil {
+		return true
+	}
+	_, ok := perms.Extensions[ext]
+	return ok
+}
+
+// certForceCommand 返回证书中的 force-command
+func certForceCommand(ctx sshd.Context) (string, bool) {
+	perms := certPermissions(ctx)
+	if perms == nil {
+		return "", false
+	}
+	command, ok := perms.CriticalOptions[certOptionForceCommand]
+	return command, ok
+}
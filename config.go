@@ -1,19 +1,64 @@
 package main
 
 import (
+	"bytes"
 	"encoding/json"
+	"errors"
+	"fmt"
+	sshd "github.com/gliderlabs/ssh"
+	"golang.org/x/crypto/ssh"
+	"io/fs"
 	"os"
+	"strconv"
+	"strings"
 )
 
+// EnvPrefix 环境变量前缀，如 SSH_TOOLKITS_PORT
+const EnvPrefix = "SSH_TOOLKITS_"
+
 type (
 	Config struct {
-		Port         uint16        `json:"Port"`
-		Account      Account       `json:"Account"`
-		ServerConfig *ServerConfig `json:"ServerConfig"`
+		Port              uint16              `json:"Port"`
+		Listen            []ListenAddr        `json:"Listen"` // 监听地址列表，为空时监听 *:Port
+		Account           Account             `json:"Account"`
+		Accounts          []Account           `json:"Accounts"`     // 其他账号
+		AuthBackends      []AuthBackendConfig `json:"AuthBackends"` // 配置文件中的账号之后依次询问的认证后端
+		ServerConfig      *ServerConfig       `json:"ServerConfig"`
+		HostKeys          []string            `json:"HostKeys"`          // 主机私钥文件路径，为空时使用内置私钥，同目录下的 <私钥>-cert.pub 作为主机证书
+		HostCertificates  []string            `json:"HostCertificates"`  // 额外的主机证书文件路径，按公钥匹配对应的私钥
+		AuthorizedKeys    []string            `json:"AuthorizedKeys"`    // authorized_keys 格式的公钥，为空时使用内置公钥
+		TrustedUserCAKeys []string            `json:"TrustedUserCAKeys"` // authorized_keys 格式的用户 CA 公钥，由其签发的证书可以登录
+		ShutdownTimeout   int                 `json:"ShutdownTimeout"`   // 收到 SIGTERM 后等待会话结束的秒数
+		Daemon            DaemonConfig        `json:"Daemon"`
+		Log               LogConfig           `json:"Log"`
+		Audit             AuditConfig         `json:"Audit"`
+		Record            RecordConfig        `json:"Record"`
+		Metrics           MetricsConfig       `json:"Metrics"`
+		BruteForce        GuardConfig         `json:"BruteForce"`
+		Access            IPRules             `json:"Access"`   // 允许连接的来源网段，在建立连接时检查
+		Encoding          string              `json:"Encoding"` // 命令使用的字符集，如 gb18030、big5、shift-jis，默认 auto 按系统代码页选择
+		X11               X11Config           `json:"X11"`
+		TCPForwarding     bool                `json:"TCPForwarding"` // 允许 ssh -L 本地端口转发，默认关闭
+		Login             LoginConfig         `json:"Login"`
+		Timeout           TimeoutConfig       `json:"Timeout"`
+		Limits            LimitsConfig        `json:"Limits"`
+		Resources         ResourceLimits      `json:"Resources"` // 会话中命令的资源限制
+		Exec              ExecConfig          `json:"Exec"`
+		CgroupRoot        string              `json:"CgroupRoot"` // cgroup v2 目录，如 /sys/fs/cgroup/ssh_toolkits，每个会话在其中创建子目录
 	}
 	Account struct {
-		Username string `json:"Username"`
-		Password string `json:"Password"`
+		Username               string         `json:"Username"`
+		Password               string         `json:"Password"`
+		Access                 IPRules        `json:"Access"`                 // 允许该账号登录的来源网段，在认证时检查
+		TOTPSecret             string         `json:"TOTPSecret"`             // base32 格式的 TOTP 密钥，设置后密码或公钥认证通过后还需要输入验证码
+		Encoding               string         `json:"Encoding"`               // 为空时使用全局配置
+		DisableAgentForwarding bool           `json:"DisableAgentForwarding"` // 禁止该账号使用 ssh -A 转发 agent
+		DisableX11Forwarding   bool           `json:"DisableX11Forwarding"`   // 禁止该账号使用 ssh -X 转发 X11
+		DisablePortForwarding  bool           `json:"DisablePortForwarding"`  // 禁止该账号使用 ssh -L 转发端口
+		IdleTimeout            int            `json:"IdleTimeout"`            // 为 0 时使用全局配置，负数表示不限制
+		MaxTimeout             int            `json:"MaxTimeout"`             // 为 0 时使用全局配置，负数表示不限制
+		MaxConnections         int            `json:"MaxConnections"`         // 该账号同时存在的连接数，为 0 时使用 Limits.MaxConnectionsPerUser
+		Resources              ResourceLimits `json:"Resources"`              // 设置的项覆盖全局配置
 	}
 	ServerConfig struct {
 		MaxAuthTries int      `json:"MaxAuthTries"`
@@ -45,4 +90,315 @@ func (c *Config) SetDefault() {
 	if c.Account.Password == "" {
 		c.Account.Password = "tools"
 	}
+	if c.ShutdownTimeout == 0 {
+		c.ShutdownTimeout = 30
+	}
+	c.Daemon.SetDefault()
+	c.Log.SetDefault()
+	c.Record.SetDefault()
+	c.BruteForce.SetDefault()
+	c.X11.SetDefault()
+	c.Login.SetDefault()
+	c.Timeout.SetDefault()
+	c.Limits.SetDefault()
+	c.Exec.SetDefault()
+}
+
+// BuildConfig 按 默认值 -> 配置文件 -> 环境变量 -> 命令行 的顺序合并配置。
+// 配置文件或环境变量有误时仍返回其余各层合并后的结果，同时返回错误，配置文件解析失败的错误优先，命令行参数总是生效
+func BuildConfig(file string, environ []string, override func(*Config)) (Config, error) {
+	cfg, err := LoadConfig(file)
+	if err != nil {
+		cfg = Config{}
+	}
+	cfg.SetDefault()
+	if envErr := cfg.ApplyEnv(environ); envErr != nil && (err == nil || errors.Is(err, fs.ErrNotExist)) {
+		err = envErr
+	}
+	if override != nil {
+		override(&cfg)
+	}
+	return cfg, err
+}
+
+// ApplyEnv 使用 SSH_TOOLKITS_* 环境变量覆盖配置，解析失败的变量跳过，返回第一个错误
+func (c *Config) ApplyEnv(environ []string) (err error) {
+	fail := func(name string, e error) {
+		if err == nil {
+			err = errors.New(fmt.Sprintf("parse %s%s err:%s", EnvPrefix, name, e.Error()))
+		}
+	}
+	for _, kv := range environ {
+		if !strings.HasPrefix(kv, EnvPrefix) {
+			continue
+		}
+		key, val, _ := strings.Cut(strings.TrimPrefix(kv, EnvPrefix), "=")
+		switch key {
+		case "PORT":
+			port, e := strconv.ParseUint(val, 10, 16)
+			if e != nil {
+				fail("PORT", e)
+				continue
+			}
+			c.Port = uint16(port)
+		case "LISTEN":
+			c.Listen = make([]ListenAddr, 0)
+			for _, addr := range splitList(val) {
+				c.Listen = append(c.Listen, ListenAddr{Address: addr})
+			}
+		case "USERNAME":
+			c.Account.Username = val
+		case "PASSWORD":
+			c.Account.Password = val
+		case "TOTP_SECRET":
+			c.Account.TOTPSecret = val
+		case "HOST_KEYS":
+			c.HostKeys = splitList(val)
+		case "AUTHORIZED_KEYS":
+			c.AuthorizedKeys = splitList(val)
+		case "SHUTDOWN_TIMEOUT":
+			timeout, e := strconv.Atoi(val)
+			if e != nil {
+				fail("SHUTDOWN_TIMEOUT", e)
+				continue
+			}
+			c.ShutdownTimeout = timeout
+		case "PID_FILE":
+			c.Daemon.PidFile = val
+		case "LOG_FILE":
+			c.Daemon.LogFile = val
+		case "AUDIT_FILE":
+			c.Audit.File = val
+		case "RECORD_DIR":
+			c.Record.Enable = val != ""
+			c.Record.Dir = val
+		case "METRICS_LISTEN":
+			c.Metrics.Listen = val
+		case "ALLOW_FROM":
+			c.Access.AllowFrom = splitList(val)
+		case "DENY_FROM":
+			c.Access.DenyFrom = splitList(val)
+		case "ENCODING":
+			c.Encoding = val
+		case "X11_FORWARDING":
+			enable, e := strconv.ParseBool(val)
+			if e != nil {
+				fail("X11_FORWARDING", e)
+				continue
+			}
+			c.X11.Enable = enable
+		case "TCP_FORWARDING":
+			enable, e := strconv.ParseBool(val)
+			if e != nil {
+				fail("TCP_FORWARDING", e)
+				continue
+			}
+			c.TCPForwarding = enable
+		case "IDLE_TIMEOUT":
+			n, e := strconv.Atoi(val)
+			if e != nil {
+				fail("IDLE_TIMEOUT", e)
+				continue
+			}
+			c.Timeout.IdleTimeout = n
+		case "MAX_TIMEOUT":
+			n, e := strconv.Atoi(val)
+			if e != nil {
+				fail("MAX_TIMEOUT", e)
+				continue
+			}
+			c.Timeout.MaxTimeout = n
+		case "CLIENT_ALIVE_INTERVAL":
+			n, e := strconv.Atoi(val)
+			if e != nil {
+				fail("CLIENT_ALIVE_INTERVAL", e)
+				continue
+			}
+			c.Timeout.ClientAliveInterval = n
+		case "MAX_CONNECTIONS":
+			n, e := strconv.Atoi(val)
+			if e != nil {
+				fail("MAX_CONNECTIONS", e)
+				continue
+			}
+			c.Limits.MaxConnections = n
+		case "MAX_SESSIONS":
+			n, e := strconv.Atoi(val)
+			if e != nil {
+				fail("MAX_SESSIONS", e)
+				continue
+			}
+			c.Limits.MaxSessions = n
+		case "MAX_STARTUPS":
+			c.Limits.MaxStartups = val
+		case "EXEC_TIMEOUT":
+			n, e := strconv.Atoi(val)
+			if e != nil {
+				fail("EXEC_TIMEOUT", e)
+				continue
+			}
+			c.Exec.Timeout = n
+		case "EXEC_MAX_OUTPUT":
+			n, e := strconv.ParseInt(val, 10, 64)
+			if e != nil {
+				fail("EXEC_MAX_OUTPUT", e)
+				continue
+			}
+			c.Exec.MaxOutput = n
+		case "CGROUP_ROOT":
+			c.CgroupRoot = val
+		case "BANNER_FILE":
+			c.Login.BannerFile = val
+		case "MOTD_FILE":
+			c.Login.MOTDFile = val
+		case "LOG_LEVEL":
+			c.Log.Level = val
+		case "LOG_FORMAT":
+			c.Log.Format = val
+		}
+	}
+	return err
+}
+
+// Validate 检查需要在加载时发现的配置错误，启动时出错直接退出，重新加载时保留原配置
+func (c *Config) Validate() error {
+	if err := c.Access.Validate(); err != nil {
+		return errors.New(fmt.Sprintf("Access: %s", err.Error()))
+	}
+	if err := c.Limits.Validate(); err != nil {
+		return errors.New(fmt.Sprintf("Limits: %s", err.Error()))
+	}
+	for _, account := range append([]Account{c.Account}, c.Accounts...) {
+		if err := account.Access.Validate(); err != nil {
+			return errors.New(fmt.Sprintf("account %s Access: %s", account.Username, err.Error()))
+		}
+	}
+	return nil
+}
+
+// LookupAccount 按用户名查找账号，不存在时返回 nil
+func (c *Config) LookupAccount(username string) *Account {
+	if c.Account.Username == username {
+		return &c.Account
+	}
+	for i := range c.Accounts {
+		if c.Accounts[i].Username == username {
+			return &c.Accounts[i]
+		}
+	}
+	return nil
+}
+
+// Redacted 返回隐藏了密码等敏感信息的配置副本，用于打印
+func (c Config) Redacted() Config {
+	c.Account = c.Account.Redacted()
+	accounts := make([]Account, 0, len(c.Accounts))
+	for _, account := range c.Accounts {
+		accounts = append(accounts, account.Redacted())
+	}
+	c.Accounts = accounts
+	return c
+}
+
+func (a Account) Redacted() Account {
+	if a.Password != "" {
+		a.Password = redacted
+	}
+	if a.TOTPSecret != "" {
+		a.TOTPSecret = redacted
+	}
+	return a
+}
+
+const redacted = "******"
+
+func splitList(val string) []string {
+	list := make([]string, 0)
+	for _, item := range strings.Split(val, ",") {
+		item = strings.TrimSpace(item)
+		if item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+// HostSigners 加载主机私钥
+func (c *Config) HostSigners() ([]sshd.Signer, error) {
+	if len(c.HostKeys) == 0 {
+		signer, err := ssh.ParsePrivateKey([]byte(PRIKEY))
+		if err != nil {
+			return nil, err
+		}
+		return []sshd.Signer{signer}, nil
+	}
+	signers := make([]sshd.Signer, 0, len(c.HostKeys))
+	for _, file := range c.HostKeys {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		signer, err := ssh.ParsePrivateKey(data)
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("parse host key %s err:%s", file, err.Error()))
+		}
+		signers = append(signers, signer)
+	}
+	certFiles := make([]string, 0, len(c.HostKeys)+len(c.HostCertificates))
+	for _, file := range c.HostKeys {
+		if _, err := os.Stat(file + "-cert.pub"); err == nil {
+			certFiles = append(certFiles, file+"-cert.pub")
+		}
+	}
+	certFiles = append(certFiles, c.HostCertificates...)
+	// 证书签名器的类型与私钥不同，两者同时提供，不信任 CA 的客户端仍可使用原来的主机密钥
+	certSigners := make([]sshd.Signer, 0, len(certFiles))
+	for _, file := range certFiles {
+		signer, err := hostCertSigner(file, signers)
+		if err != nil {
+			return nil, err
+		}
+		certSigners = append(certSigners, signer)
+	}
+	return append(signers, certSigners...), nil
+}
+
+// hostCertSigner 读取主机证书，并与公钥相同的私钥组合成证书签名器
+func hostCertSigner(file string, signers []sshd.Signer) (sshd.Signer, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	pub, _, _, _, err := ssh.ParseAuthorizedKey(data)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("parse host certificate %s err:%s", file, err.Error()))
+	}
+	cert, ok := pub.(*ssh.Certificate)
+	if !ok || cert.CertType != ssh.HostCert {
+		return nil, errors.New(fmt.Sprintf("%s is not a host certificate", file))
+	}
+	for _, signer := range signers {
+		if bytes.Equal(signer.PublicKey().Marshal(), cert.Key.Marshal()) {
+			return ssh.NewCertSigner(cert, signer)
+		}
+	}
+	return nil, errors.New(fmt.Sprintf("no host key matches certificate %s", file))
+}
+
+// IsAuthorizedKey 判断公钥是否在允许列表中
+func (c *Config) IsAuthorizedKey(key ssh.PublicKey) bool {
+	authorizedKeys := c.AuthorizedKeys
+	if len(authorizedKeys) == 0 {
+		authorizedKeys = []string{PUBKEY}
+	}
+	for _, line := range authorizedKeys {
+		pk, _, _, _, err := ssh.ParseAuthorizedKey([]byte(line))
+		if err != nil {
+			continue
+		}
+		if bytes.Equal(key.Marshal(), pk.Marshal()) {
+			return true
+		}
+	}
+	return false
 }
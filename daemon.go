@@ -0,0 +1,208 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const (
+	// daemonRoleEnv 标记后台进程的角色，supervisor 负责守护，worker 提供服务
+	daemonRoleEnv        = EnvPrefix + "DAEMON_ROLE"
+	daemonRoleSupervisor = "supervisor"
+	daemonRoleWorker     = "worker"
+)
+
+var ErrPidFileLocked = errors.New("pid file is locked by another process")
+
+type (
+	DaemonConfig struct {
+		PidFile       string `json:"PidFile"`
+		LogFile       string `json:"LogFile"`
+		LogMaxSize    int    `json:"LogMaxSize"`    // 单个日志文件大小上限，单位MB
+		LogMaxBackups int    `json:"LogMaxBackups"` // 保留的历史日志个数
+	}
+)
+
+func (c *DaemonConfig) SetDefault() {
+	if c.PidFile == "" {
+		c.PidFile = "./ssh_toolkits.pid"
+	}
+	if c.LogFile == "" {
+		c.LogFile = "./ssh_toolkits.log"
+	}
+	if c.LogMaxSize == 0 {
+		c.LogMaxSize = 10
+	}
+	if c.LogMaxBackups == 0 {
+		c.LogMaxBackups = 5
+	}
+}
+
+func daemonRole() string {
+	return os.Getenv(daemonRoleEnv)
+}
+
+// StartDaemon 以后台方式重新启动自身，由 supervisor 进程持有 pid 文件并守护 worker
+func StartDaemon(cfg DaemonConfig) error {
+	if pid, running := daemonStatus(cfg); running {
+		return errors.New(fmt.Sprintf("already running, pid:%d", pid))
+	}
+	devNull, err := os.OpenFile(os.DevNull, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	defer devNull.Close()
+	cmd := exec.Command(os.Args[0], os.Args[1:]...)
+	cmd.Env = append(os.Environ(), daemonRoleEnv+"="+daemonRoleSupervisor)
+	cmd.Stdin = devNull
+	cmd.Stdout = devNull
+	cmd.Stderr = devNull
+	cmd.SysProcAttr = detachedProcAttr()
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	fmt.Printf("started, pid:%d\n", cmd.Process.Pid)
+	return cmd.Process.Release()
+}
+
+// RunSupervisor 持有 pid 文件，启动 worker 并在其异常退出时重启，同时转发信号
+func RunSupervisor(cfg DaemonConfig, logCfg LogConfig) error {
+	pidFile, err := lockPidFile(cfg.PidFile)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = pidFile.Close()
+		_ = os.Remove(cfg.PidFile)
+	}()
+	if err := pidFile.Truncate(0); err != nil {
+		return err
+	}
+	if _, err := pidFile.WriteAt([]byte(strconv.Itoa(os.Getpid())+"\n"), 0); err != nil {
+		return err
+	}
+
+	logWriter, err := NewRotateWriter(cfg.LogFile, int64(cfg.LogMaxSize)<<20, cfg.LogMaxBackups)
+	if err != nil {
+		return err
+	}
+	defer logWriter.Close()
+	log := NewLogger(logWriter, logCfg).With("subsystem", "supervisor")
+	if err := bindChildren(); err != nil {
+		log.Warn("bind worker to supervisor failed, stop may leave the worker running", "err", err)
+	}
+
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGTERM, syscall.SIGHUP, os.Interrupt)
+	defer signal.Stop(sigCh)
+
+	var (
+		backoff  = time.Second
+		stopping = false
+	)
+	for {
+		cmd := exec.Command(os.Args[0], os.Args[1:]...)
+		cmd.Env = append(os.Environ(), daemonRoleEnv+"="+daemonRoleWorker)
+		cmd.Stdout = logWriter
+		cmd.Stderr = logWriter
+		startAt := time.Now()
+		if err := cmd.Start(); err != nil {
+			return err
+		}
+		log.Info("worker started", "pid", cmd.Process.Pid)
+
+		done := make(chan error, 1)
+		go func() {
+			done <- cmd.Wait()
+		}()
+		var waitErr error
+	wait:
+		for {
+			select {
+			case sig := <-sigCh:
+				if sig != syscall.SIGHUP {
+					stopping = true
+				}
+				_ = signalProcess(cmd.Process, sig)
+			case waitErr = <-done:
+				break wait
+			}
+		}
+		if stopping || waitErr == nil {
+			log.Info("worker exited, stop")
+			return nil
+		}
+		// 运行足够久则认为之前的故障已恢复，重置退避时间
+		if time.Since(startAt) > time.Minute {
+			backoff = time.Second
+		}
+		log.Warn("worker exited, restarting", "err", waitErr, "backoff", backoff)
+		select {
+		case sig := <-sigCh:
+			if sig != syscall.SIGHUP {
+				return nil
+			}
+		case <-time.After(backoff):
+		}
+		if backoff *= 2; backoff > time.Minute {
+			backoff = time.Minute
+		}
+	}
+}
+
+// DaemonStatus 打印后台进程状态
+func DaemonStatus(cfg DaemonConfig) error {
+	pid, running := daemonStatus(cfg)
+	if !running {
+		return errors.New("not running")
+	}
+	fmt.Printf("running, pid:%d\n", pid)
+	return nil
+}
+
+// StopDaemon 通知后台进程退出，并等待其释放 pid 文件
+func StopDaemon(cfg DaemonConfig, timeout time.Duration) error {
+	pid, running := daemonStatus(cfg)
+	if !running {
+		return errors.New("not running")
+	}
+	p, err := os.FindProcess(pid)
+	if err != nil {
+		return err
+	}
+	if err := signalProcess(p, syscall.SIGTERM); err != nil {
+		return err
+	}
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		if _, running := daemonStatus(cfg); !running {
+			fmt.Printf("stopped, pid:%d\n", pid)
+			return nil
+		}
+		time.Sleep(200 * time.Millisecond)
+	}
+	return errors.New(fmt.Sprintf("pid:%d still running after %s", pid, timeout))
+}
+
+// daemonStatus 根据 pid 文件的锁判断后台进程是否在运行
+func daemonStatus(cfg DaemonConfig) (int, bool) {
+	if !pidFileLocked(cfg.PidFile) {
+		return 0, false
+	}
+	data, err := os.ReadFile(cfg.PidFile)
+	if err != nil {
+		return 0, false
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil {
+		return 0, false
+	}
+	return pid, true
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"syscall"
+)
+
+func detachedProcAttr() *syscall.SysProcAttr {
+	return &syscall.SysProcAttr{Setsid: true}
+}
+
+// lockPidFile 打开并以排他锁锁定 pid 文件，进程退出后锁自动释放
+func lockPidFile(path string) (*os.File, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	err = syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+	if err != nil {
+		_ = f.Close()
+		if errors.Is(err, syscall.EWOULDBLOCK) {
+			return nil, ErrPidFileLocked
+		}
+		return nil, err
+	}
+	return f, nil
+}
+
+func pidFileLocked(path string) bool {
+	f, err := os.Open(path)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	err = syscall.Flock(int(f.Fd()), syscall.LOCK_SH|syscall.LOCK_NB)
+	if err != nil {
+		return errors.Is(err, syscall.EWOULDBLOCK)
+	}
+	_ = syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+	return false
+}
+
+// bindChildren supervisor 收到的信号会转发给 worker，linux 上不需要额外处理
+func bindChildren() error {
+	return nil
+}
+
+func signalProcess(p *os.Process, sig os.Signal) error {
+	return p.Signal(sig)
+}
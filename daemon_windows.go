@@ -0,0 +1,115 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+const (
+	detachedProcess       = 0x00000008
+	errorSharingViolation = syscall.Errno(32)
+
+	jobObjectExtendedLimitInformation = 9
+	jobObjectLimitKillOnJobClose      = 0x00002000
+)
+
+var (
+	kernel32                     = syscall.NewLazyDLL("kernel32.dll")
+	procCreateJobObjectW         = kernel32.NewProc("CreateJobObjectW")
+	procSetInformationJobObject  = kernel32.NewProc("SetInformationJobObject")
+	procAssignProcessToJobObject = kernel32.NewProc("AssignProcessToJobObject")
+)
+
+type (
+	// jobObjectExtendedLimit JOBOBJECT_EXTENDED_LIMIT_INFORMATION
+	jobObjectExtendedLimit struct {
+		PerProcessUserTimeLimit int64
+		PerJobUserTimeLimit     int64
+		LimitFlags              uint32
+		MinimumWorkingSetSize   uintptr
+		MaximumWorkingSetSize   uintptr
+		ActiveProcessLimit      uint32
+		Affinity                uintptr
+		PriorityClass           uint32
+		SchedulingClass         uint32
+		IoInfo                  [6]uint64
+		ProcessMemoryLimit      uintptr
+		JobMemoryLimit          uintptr
+		PeakProcessMemoryUsed   uintptr
+		PeakJobMemoryUsed       uintptr
+	}
+)
+
+func detachedProcAttr() *syscall.SysProcAttr {
+	return &syscall.SysProcAttr{
+		HideWindow:    true,
+		CreationFlags: syscall.CREATE_NEW_PROCESS_GROUP | detachedProcess,
+	}
+}
+
+// lockPidFile 以只允许其他进程读取的共享方式打开 pid 文件，相当于排他锁
+func lockPidFile(path string) (*os.File, error) {
+	name, err := syscall.UTF16PtrFromString(path)
+	if err != nil {
+		return nil, err
+	}
+	h, err := syscall.CreateFile(name, syscall.GENERIC_READ|syscall.GENERIC_WRITE, syscall.FILE_SHARE_READ,
+		nil, syscall.OPEN_ALWAYS, syscall.FILE_ATTRIBUTE_NORMAL, 0)
+	if err != nil {
+		if errors.Is(err, errorSharingViolation) {
+			return nil, ErrPidFileLocked
+		}
+		return nil, err
+	}
+	return os.NewFile(uintptr(h), path), nil
+}
+
+func pidFileLocked(path string) bool {
+	name, err := syscall.UTF16PtrFromString(path)
+	if err != nil {
+		return false
+	}
+	h, err := syscall.CreateFile(name, syscall.GENERIC_WRITE, syscall.FILE_SHARE_READ|syscall.FILE_SHARE_WRITE,
+		nil, syscall.OPEN_EXISTING, syscall.FILE_ATTRIBUTE_NORMAL, 0)
+	if err != nil {
+		return errors.Is(err, errorSharingViolation)
+	}
+	_ = syscall.CloseHandle(h)
+	return false
+}
+
+// bindChildren 将 supervisor 加入设置了 KILL_ON_JOB_CLOSE 的 job，之后启动的 worker 及其子进程都属于该 job。
+// windows 上 stop 只能直接结束 supervisor，job 的句柄随之关闭，worker 也会被结束
+func bindChildren() error {
+	job, _, err := procCreateJobObjectW.Call(0, 0)
+	if job == 0 {
+		return err
+	}
+	info := jobObjectExtendedLimit{LimitFlags: jobObjectLimitKillOnJobClose}
+	if ok, _, err := procSetInformationJobObject.Call(job, jobObjectExtendedLimitInformation,
+		uintptr(unsafe.Pointer(&info)), unsafe.Sizeof(info)); ok == 0 {
+		_ = syscall.CloseHandle(syscall.Handle(job))
+		return err
+	}
+	self, err := syscall.GetCurrentProcess()
+	if err != nil {
+		_ = syscall.CloseHandle(syscall.Handle(job))
+		return err
+	}
+	if ok, _, err := procAssignProcessToJobObject.Call(job, uintptr(self)); ok == 0 {
+		_ = syscall.CloseHandle(syscall.Handle(job))
+		return err
+	}
+	// job 的句柄在 supervisor 退出时由系统关闭
+	return nil
+}
+
+// signalProcess windows 不支持向其他进程发送信号，SIGHUP 忽略，其余直接结束进程
+func signalProcess(p *os.Process, sig os.Signal) error {
+	if sig == syscall.SIGHUP {
+		return nil
+	}
+	return p.Kill()
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/htmlindex"
+	"golang.org/x/text/encoding/ianaindex"
+	"golang.org/x/text/encoding/unicode"
+	"golang.org/x/text/transform"
+	"io"
+	"strings"
+)
+
+// EncodingAuto 按系统代码页或 locale 选择字符集
+const EncodingAuto = "auto"
+
+type (
+	// sessionCodec 在客户端的 UTF-8 与命令使用的字符集之间转换，nil 表示不转换
+	sessionCodec struct {
+		enc     encoding.Encoding
+		writers []*transform.Writer
+	}
+)
+
+// LookupEncoding 按名称查找字符集，支持 utf-8、gb18030、gbk、big5、shift-jis、windows-1252、ibm437 等，
+// 为空或 auto 时使用系统字符集，UTF-8 返回 nil
+func LookupEncoding(name string) (encoding.Encoding, error) {
+	name = strings.ToLower(strings.TrimSpace(name))
+	if name == "" || name == EncodingAuto {
+		name = systemCharset()
+	}
+	enc, err := htmlindex.Get(name)
+	if err != nil {
+		// ibm437、ibm850 等 OEM 代码页不在 htmlindex 中
+		if enc, err = ianaindex.IANA.Encoding(name); err != nil || enc == nil {
+			return nil, errors.New(fmt.Sprintf("unknown encoding %s", name))
+		}
+	}
+	if enc == unicode.UTF8 {
+		return nil, nil
+	}
+	return enc, nil
+}
+
+// SessionEncoding 返回用户会话使用的字符集，账号的配置优先于全局配置
+func (c *Config) SessionEncoding(user string) (encoding.Encoding, error) {
+	name := c.Encoding
+	if account := c.LookupAccount(user); account != nil && account.Encoding != "" {
+		name = account.Encoding
+	}
+	return LookupEncoding(name)
+}
+
+func newSessionCodec(enc encoding.Encoding) *sessionCodec {
+	if enc == nil {
+		return nil
+	}
+	return &sessionCodec{enc: enc}
+}
+
+// Input 将客户端输入转换为命令的字符集，无法表示的字符会被替换
+func (c *sessionCodec) Input(r io.Reader) io.Reader {
+	if c == nil {
+		return r
+	}
+	return transform.NewReader(r, encoding.ReplaceUnsupported(c.enc.NewEncoder()))
+}
+
+// Output 将命令输出转换为 UTF-8，会话结束时需要调用 Close 写出剩余的字节
+func (c *sessionCodec) Output(w io.Writer) io.Writer {
+	if c == nil {
+		return w
+	}
+	tw := transform.NewWriter(w, c.enc.NewDecoder())
+	c.writers = append(c.writers, tw)
+	return tw
+}
+
+// OutputReader 将从 r 读到的命令输出转换为 UTF-8
+func (c *sessionCodec) OutputReader(r io.Reader) io.Reader {
+	if c == nil {
+		return r
+	}
+	return transform.NewReader(r, c.enc.NewDecoder())
+}
+
+func (c *sessionCodec) Close() {
+	if c == nil {
+		return
+	}
+	for _, w := range c.writers {
+		_ = w.Close()
+	}
+}
@@ -0,0 +1,23 @@
+package main
+
+import (
+	"os"
+	"strings"
+)
+
+// systemCharset 从 locale 环境变量中取字符集，如 zh_CN.GB18030，未设置时为 UTF-8
+func systemCharset() string {
+	for _, key := range []string{"LC_ALL", "LC_CTYPE", "LANG"} {
+		val := os.Getenv(key)
+		if val == "" {
+			continue
+		}
+		_, charset, ok := strings.Cut(val, ".")
+		if !ok {
+			return "utf-8"
+		}
+		charset, _, _ = strings.Cut(charset, "@")
+		return charset
+	}
+	return "utf-8"
+}
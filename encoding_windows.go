@@ -0,0 +1,39 @@
+package main
+
+import (
+	"fmt"
+	"syscall"
+)
+
+var (
+	procGetConsoleOutputCP = syscall.NewLazyDLL("kernel32.dll").NewProc("GetConsoleOutputCP")
+	procGetOEMCP           = syscall.NewLazyDLL("kernel32.dll").NewProc("GetOEMCP")
+)
+
+// systemCharset 按控制台输出代码页选择字符集，cmd.exe 等控制台程序按它输出，
+// 没有控制台（如作为服务运行）时使用 OEM 代码页
+func systemCharset() string {
+	cp, _, _ := procGetConsoleOutputCP.Call()
+	if cp == 0 {
+		cp, _, _ = procGetOEMCP.Call()
+	}
+	switch {
+	case cp == 65001:
+		return "utf-8"
+	case cp == 936:
+		return "gb18030"
+	case cp == 950:
+		return "big5"
+	case cp == 932:
+		return "shift_jis"
+	case cp == 949:
+		return "euc-kr"
+	case cp == 858:
+		return "ibm00858"
+	case cp == 874, cp >= 1250 && cp <= 1258:
+		return fmt.Sprintf("windows-%d", cp)
+	default:
+		// 437、850、866 等 OEM 代码页
+		return fmt.Sprintf("ibm%d", cp)
+	}
+}
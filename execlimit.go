@@ -0,0 +1,238 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	sshd "github.com/gliderlabs/ssh"
+	"golang.org/x/crypto/ssh"
+	"io"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// clientTimeoutEnv 客户端通过 SendEnv 设置 exec 超时，如 ssh -o SetEnv=SSH_TOOLKITS_TIMEOUT=30 host cmd
+const clientTimeoutEnv = EnvPrefix + "TIMEOUT"
+
+type (
+	// ExecConfig exec 会话的运行时间和输出限制，0 表示不限制
+	ExecConfig struct {
+		Timeout            int   `json:"Timeout"`            // 最长运行秒数，超时后向进程组发送 SIGTERM
+		AllowClientTimeout bool  `json:"AllowClientTimeout"` // 允许客户端通过 SSH_TOOLKITS_TIMEOUT 设置超时，设置了 Timeout 时不能超过 Timeout
+		KillGrace          int   `json:"KillGrace"`          // 发送 SIGTERM 后等待多少秒再发送 SIGKILL
+		MaxOutput          int64 `json:"MaxOutput"`          // stdout 和 stderr 合计的最大字节数，超出的部分丢弃并终止命令
+	}
+
+	// execLimit 限制一次 exec 的运行时间和输出大小，nil 表示不限制
+	execLimit struct {
+		timeout   time.Duration
+		grace     time.Duration
+		maxOutput int64
+
+		mu      sync.Mutex
+		cmd     *exec.Cmd
+		output  int64
+		reason  string
+		done    chan struct{}
+		timer   *time.Timer
+		stopped bool
+	}
+	limitWriter struct {
+		w io.Writer
+		l *execLimit
+	}
+	exitSignalMsg struct {
+		Signal     string
+		CoreDumped bool
+		Errmsg     string
+		Lang       string
+	}
+)
+
+func (c *ExecConfig) SetDefault() {
+	if c.KillGrace == 0 {
+		c.KillGrace = 5
+	}
+}
+
+// newExecLimit 按配置和客户端的 SSH_TOOLKITS_TIMEOUT 计算会话的限制
+func newExecLimit(cfg ExecConfig, sess sshd.Session) (*execLimit, error) {
+	timeout := seconds(cfg.Timeout)
+	if cfg.AllowClientTimeout {
+		for _, kv := range sess.Environ() {
+			if !strings.HasPrefix(kv, clientTimeoutEnv+"=") {
+				continue
+			}
+			t, err := parseTimeout(strings.TrimPrefix(kv, clientTimeoutEnv+"="))
+			if err != nil {
+				return nil, err
+			}
+			if timeout == 0 || (t > 0 && t < timeout) {
+				timeout = t
+			}
+		}
+	}
+	if timeout == 0 && cfg.MaxOutput <= 0 {
+		return nil, nil
+	}
+	return &execLimit{
+		timeout:   timeout,
+		grace:     seconds(cfg.KillGrace),
+		maxOutput: cfg.MaxOutput,
+		done:      make(chan struct{}),
+	}, nil
+}
+
+// parseTimeout 支持秒数或 time.ParseDuration 的格式，如 30、1m30s
+func parseTimeout(val string) (time.Duration, error) {
+	if n, err := strconv.Atoi(val); err == nil && n >= 0 {
+		return time.Duration(n) * time.Second, nil
+	}
+	d, err := time.ParseDuration(val)
+	if err != nil || d < 0 {
+		return 0, errors.New(fmt.Sprintf("invalid %s %q", clientTimeoutEnv, val))
+	}
+	return d, nil
+}
+
+// Prepare 在启动前让命令运行在独立的进程组中，终止时连同子进程一起终止
+func (l *execLimit) Prepare(cmd *exec.Cmd) {
+	if l == nil {
+		return
+	}
+	setProcessGroup(cmd)
+}
+
+// Writer 统计写入的字节数，超出 MaxOutput 后丢弃并终止命令
+func (l *execLimit) Writer(w io.Writer) io.Writer {
+	if l == nil || l.maxOutput <= 0 {
+		return w
+	}
+	return &limitWriter{w: w, l: l}
+}
+
+// Start 命令启动后开始计时
+func (l *execLimit) Start(cmd *exec.Cmd) {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.cmd = cmd
+	if l.timeout > 0 {
+		l.timer = time.AfterFunc(l.timeout, func() {
+			l.terminate(fmt.Sprintf("command timed out after %s", l.timeout))
+		})
+	}
+}
+
+// Stop 命令结束后调用，停止计时和后续的 SIGKILL
+func (l *execLimit) Stop() {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.stopped {
+		return
+	}
+	l.stopped = true
+	if l.timer != nil {
+		l.timer.Stop()
+	}
+	close(l.done)
+}
+
+// Reason 返回服务端终止命令的原因，没有终止时为空
+func (l *execLimit) Reason() string {
+	if l == nil {
+		return ""
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.reason
+}
+
+// terminate 向进程组发送 SIGTERM，KillGrace 后仍未结束时发送 SIGKILL。
+// 进程组中的子进程可能在主进程退出后仍占用输出，因此不论主进程是否退出都发送 SIGKILL
+func (l *execLimit) terminate(reason string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.reason != "" || l.stopped || l.cmd == nil || l.cmd.Process == nil {
+		return
+	}
+	l.reason = reason
+	p := l.cmd.Process
+	_ = signalProcessGroup(p, syscall.SIGTERM)
+	go func() {
+		select {
+		case <-l.done:
+		case <-time.After(l.grace):
+			_ = signalProcessGroup(p, syscall.SIGKILL)
+		}
+	}()
+}
+
+func (w *limitWriter) Write(p []byte) (int, error) {
+	l := w.l
+	l.mu.Lock()
+	remain := l.maxOutput - l.output
+	if remain < 0 {
+		remain = 0
+	}
+	n := int64(len(p))
+	if n > remain {
+		n = remain
+	}
+	l.output += int64(len(p))
+	l.mu.Unlock()
+	if n > 0 {
+		if _, err := w.w.Write(p[:n]); err != nil {
+			return 0, err
+		}
+	}
+	if n < int64(len(p)) {
+		// 继续读取并丢弃输出，避免命令阻塞在写管道上无法处理 SIGTERM
+		l.terminate(fmt.Sprintf("output exceeded %d bytes", l.maxOutput))
+	}
+	return len(p), nil
+}
+
+// exitSignal 命令被信号终止时向客户端发送 exit-signal 并关闭会话
+func exitSignal(sess sshd.Session, sig sshd.Signal, msg string) {
+	_, _ = sess.SendRequest("exit-signal", false, ssh.Marshal(&exitSignalMsg{Signal: string(sig), Errmsg: msg}))
+	_ = sess.Close()
+}
+
+// sshSignal 将系统信号转换为 RFC 4254 中的信号名
+func sshSignal(sig syscall.Signal) sshd.Signal {
+	switch sig {
+	case syscall.SIGABRT:
+		return sshd.SIGABRT
+	case syscall.SIGALRM:
+		return sshd.SIGALRM
+	case syscall.SIGFPE:
+		return sshd.SIGFPE
+	case syscall.SIGHUP:
+		return sshd.SIGHUP
+	case syscall.SIGILL:
+		return sshd.SIGILL
+	case syscall.SIGINT:
+		return sshd.SIGINT
+	case syscall.SIGKILL:
+		return sshd.SIGKILL
+	case syscall.SIGPIPE:
+		return sshd.SIGPIPE
+	case syscall.SIGQUIT:
+		return sshd.SIGQUIT
+	case syscall.SIGSEGV:
+		return sshd.SIGSEGV
+	case syscall.SIGTERM:
+		return sshd.SIGTERM
+	default:
+		return ""
+	}
+}
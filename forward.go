@@ -0,0 +1,90 @@
+package main
+
+import (
+	sshd "github.com/gliderlabs/ssh"
+	"golang.org/x/crypto/ssh"
+	"net"
+	"strconv"
+	"sync"
+)
+
+const directTCPIPChannelType = "direct-tcpip"
+
+type (
+	// forwardNewChannel 接受 channel 后返回 forwardChannel，拒绝或接受失败时释放会话名额
+	forwardNewChannel struct {
+		ssh.NewChannel
+		act     *connActivity
+		release func()
+	}
+
+	// forwardChannel 转发的数据算作连接的活动，关闭时结束会话统计并释放会话名额
+	forwardChannel struct {
+		ssh.Channel
+		act     *connActivity
+		once    sync.Once
+		end     func()
+		release func()
+	}
+)
+
+// directTCPIPHandler 处理 ssh -L 的端口转发，是否允许由 portForwardingCallback 决定
+func (s *Server) directTCPIPHandler(srv *sshd.Server, conn *ssh.ServerConn, newChan ssh.NewChannel, ctx sshd.Context) {
+	act, _ := ctx.Value(ctxKeyActivity).(*connActivity)
+	act.SetConn(conn)
+	// 与 session 共用 MaxSessions，DirectTCPIPHandler 启动转发后立即返回，名额在 channel 关闭时释放
+	release := s.acquireSession(ctx, conn, newChan)
+	if release == nil {
+		return
+	}
+	sshd.DirectTCPIPHandler(srv, conn, &forwardNewChannel{NewChannel: newChan, act: act, release: release}, ctx)
+}
+
+// portForwardingCallback 需要开启 TCPForwarding，账号未禁止，且证书允许 permit-port-forwarding
+func (s *Server) portForwardingCallback(ctx sshd.Context, host string, port uint32) bool {
+	cfg := s.Config()
+	if !cfg.TCPForwarding || !certPermits(ctx, certExtPermitPortForwarding) {
+		return false
+	}
+	if account := cfg.LookupAccount(ctx.User()); account != nil && account.DisablePortForwarding {
+		return false
+	}
+	s.log.Info("port forwarding", "session", shortSessionID(ctx), "user", ctx.User(),
+		"remote", ctx.RemoteAddr().String(), "dest", net.JoinHostPort(host, strconv.Itoa(int(port))))
+	return true
+}
+
+func (c *forwardNewChannel) Accept() (ssh.Channel, <-chan *ssh.Request, error) {
+	ch, reqs, err := c.NewChannel.Accept()
+	if err != nil {
+		c.release()
+		return ch, reqs, err
+	}
+	return &forwardChannel{Channel: ch, act: c.act, end: metrics.SessionStart(SessionTypeForward), release: c.release}, reqs, nil
+}
+
+func (c *forwardNewChannel) Reject(reason ssh.RejectionReason, message string) error {
+	c.release()
+	return c.NewChannel.Reject(reason, message)
+}
+
+func (c *forwardChannel) Read(p []byte) (int, error) {
+	n, err := c.Channel.Read(p)
+	if n > 0 {
+		c.act.Touch()
+	}
+	return n, err
+}
+
+func (c *forwardChannel) Write(p []byte) (int, error) {
+	c.act.Touch()
+	return c.Channel.Write(p)
+}
+
+func (c *forwardChannel) Close() error {
+	c.once.Do(func() {
+		c.end()
+		c.release()
+	})
+	return c.Channel.Close()
+}
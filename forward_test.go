@@ -0,0 +1,74 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+// TestForwardMaxSessions 端口转发与 session 共用 MaxSessions，拒绝和关闭时都要释放名额
+func TestForwardMaxSessions(t *testing.T) {
+	target, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer target.Close()
+	go func() {
+		for {
+			conn, err := target.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				buf := make([]byte, 1)
+				_, _ = conn.Read(buf)
+				_ = conn.Close()
+			}()
+		}
+	}()
+	closed, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closedAddr := closed.Addr().String()
+	_ = closed.Close()
+
+	cfg := Config{TCPForwarding: true}
+	cfg.Limits.MaxSessions = 1
+	_, addr := newTestServer(t, cfg, time.Second)
+	client, err := dialTestServer(addr, "tools", "tools")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	// 连接目标失败时 channel 被拒绝，名额要释放
+	if _, err := client.Dial("tcp", closedAddr); err == nil {
+		t.Fatal("forward to a closed port succeeded")
+	}
+	first, err := client.Dial("tcp", target.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.Dial("tcp", target.Addr().String()); err == nil {
+		t.Fatal("forward beyond MaxSessions succeeded")
+	}
+	if _, err := client.NewSession(); err == nil {
+		t.Fatal("session beyond MaxSessions succeeded")
+	}
+
+	// 转发关闭后名额异步释放
+	_ = first.Close()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		conn, err := client.Dial("tcp", target.Addr().String())
+		if err == nil {
+			_ = conn.Close()
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("forward slot was not released: %v", err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	AuditEventBan   = "ban"
+	AuditEventUnban = "unban"
+)
+
+type (
+	// GuardConfig 防暴力破解配置，时间单位为秒
+	GuardConfig struct {
+		Disable            bool `json:"Disable"`
+		MaxFailuresPerIP   int  `json:"MaxFailuresPerIP"`   // 同一 IP 连续失败次数达到后封禁
+		MaxFailuresPerUser int  `json:"MaxFailuresPerUser"` // 同一用户连续失败次数达到后封禁
+		FailureWindow      int  `json:"FailureWindow"`      // 超过该时间没有失败则清零计数
+		BanTime            int  `json:"BanTime"`            // 封禁时长
+		BackoffBaseMillis  int  `json:"BackoffBaseMillis"`  // 失败后的延迟，每次失败翻倍
+		BackoffMaxMillis   int  `json:"BackoffMaxMillis"`   // 延迟上限
+		MaxUnauthenticated int  `json:"MaxUnauthenticated"` // 同时存在的未认证连接上限
+		LoginGraceTime     int  `json:"LoginGraceTime"`     // 建立连接后多久内必须完成认证，默认 120，负数表示不限制，不受 Disable 影响
+	}
+
+	// Guard 记录认证失败次数，按 IP 和用户名进行退避和临时封禁
+	Guard struct {
+		mu      sync.Mutex
+		ips     map[string]*failureRecord
+		users   map[string]*failureRecord
+		pending int
+		log     Logger
+		audit   *Auditor
+	}
+	failureRecord struct {
+		failures    int
+		last        time.Time
+		bannedUntil time.Time
+	}
+)
+
+func (c *GuardConfig) SetDefault() {
+	if c.MaxFailuresPerIP == 0 {
+		c.MaxFailuresPerIP = 10
+	}
+	if c.MaxFailuresPerUser == 0 {
+		c.MaxFailuresPerUser = 20
+	}
+	if c.FailureWindow == 0 {
+		c.FailureWindow = 600
+	}
+	if c.BanTime == 0 {
+		c.BanTime = 600
+	}
+	if c.BackoffBaseMillis == 0 {
+		c.BackoffBaseMillis = 200
+	}
+	if c.BackoffMaxMillis == 0 {
+		c.BackoffMaxMillis = 5000
+	}
+	if c.MaxUnauthenticated == 0 {
+		c.MaxUnauthenticated = 64
+	}
+	if c.LoginGraceTime == 0 {
+		c.LoginGraceTime = 120
+	}
+}
+
+func NewGuard(log Logger, audit *Auditor) *Guard {
+	return &Guard{
+		ips:   make(map[string]*failureRecord),
+		users: make(map[string]*failureRecord),
+		log:   log.With("subsystem", "guard"),
+		audit: audit,
+	}
+}
+
+// IPBanned 判断 IP 是否处于封禁中
+func (g *Guard) IPBanned(ip string) bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.banned(g.ips[ip])
+}
+
+// UserBanned 判断用户是否处于封禁中
+func (g *Guard) UserBanned(user string) bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.banned(g.users[user])
+}
+
+func (g *Guard) banned(r *failureRecord) bool {
+	return r != nil && time.Now().Before(r.bannedUntil)
+}
+
+// AcquirePending 占用一个未认证连接名额，返回的函数用于释放，名额已满时返回 nil
+func (g *Guard) AcquirePending(cfg GuardConfig) func() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if !cfg.Disable && g.pending >= cfg.MaxUnauthenticated {
+		return nil
+	}
+	g.pending++
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			g.mu.Lock()
+			defer g.mu.Unlock()
+			g.pending--
+		})
+	}
+}
+
+// Pending 返回当前未认证的连接数
+func (g *Guard) Pending() int {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.pending
+}
+
+// Success 认证成功后清零计数
+func (g *Guard) Success(ip, user string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if r := g.ips[ip]; r != nil && !g.banned(r) {
+		delete(g.ips, ip)
+	}
+	if r := g.users[user]; r != nil && !g.banned(r) {
+		delete(g.users, user)
+	}
+}
+
+// Failure 记录一次认证失败，返回本次应延迟的时间，达到阈值时封禁
+func (g *Guard) Failure(cfg GuardConfig, ip, user string) time.Duration {
+	if cfg.Disable {
+		return 0
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	now := time.Now()
+	window := time.Duration(cfg.FailureWindow) * time.Second
+	ipRecord := g.record(g.ips, ip, now, window)
+	userRecord := g.record(g.users, user, now, window)
+	if ipRecord.failures >= cfg.MaxFailuresPerIP && !g.banned(ipRecord) {
+		g.ban(ipRecord, cfg, "ip", ip)
+	}
+	if userRecord.failures >= cfg.MaxFailuresPerUser && !g.banned(userRecord) {
+		g.ban(userRecord, cfg, "user", user)
+	}
+
+	failures := ipRecord.failures
+	if userRecord.failures > failures {
+		failures = userRecord.failures
+	}
+	delay := time.Duration(cfg.BackoffBaseMillis) * time.Millisecond
+	maxDelay := time.Duration(cfg.BackoffMaxMillis) * time.Millisecond
+	for i := 1; i < failures && delay < maxDelay; i++ {
+		delay *= 2
+	}
+	if delay > maxDelay {
+		delay = maxDelay
+	}
+	return delay
+}
+
+func (g *Guard) record(records map[string]*failureRecord, key string, now time.Time, window time.Duration) *failureRecord {
+	r := records[key]
+	if r == nil {
+		r = &failureRecord{}
+		records[key] = r
+	}
+	if !g.banned(r) && now.Sub(r.last) > window {
+		r.failures = 0
+	}
+	r.failures++
+	r.last = now
+	return r
+}
+
+func (g *Guard) ban(r *failureRecord, cfg GuardConfig, kind, key string) {
+	r.bannedUntil = time.Now().Add(time.Duration(cfg.BanTime) * time.Second)
+	g.log.Warn("ban", "kind", kind, "key", key, "failures", r.failures, "until", r.bannedUntil.Format(time.RFC3339))
+	ev := AuditEvent{Event: AuditEventBan, Size: int64(r.failures)}
+	g.setTarget(&ev, kind, key)
+	g.audit.Log(ev)
+	metrics.Bans.Add(1, kind)
+}
+
+// Sweep 解除到期的封禁并清理过期的计数
+func (g *Guard) Sweep(cfg GuardConfig) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	now := time.Now()
+	window := time.Duration(cfg.FailureWindow) * time.Second
+	for kind, records := range map[string]map[string]*failureRecord{"ip": g.ips, "user": g.users} {
+		for key, r := range records {
+			if !r.bannedUntil.IsZero() && !now.Before(r.bannedUntil) {
+				g.log.Info("unban", "kind", kind, "key", key)
+				ev := AuditEvent{Event: AuditEventUnban}
+				g.setTarget(&ev, kind, key)
+				g.audit.Log(ev)
+				delete(records, key)
+				continue
+			}
+			if r.bannedUntil.IsZero() && now.Sub(r.last) > window {
+				delete(records, key)
+			}
+		}
+	}
+}
+
+func (g *Guard) setTarget(ev *AuditEvent, kind, key string) {
+	if kind == "ip" {
+		ev.Remote = key
+	} else {
+		ev.User = key
+	}
+}
+
+// remoteIP 取出地址中的 IP 部分
+func remoteIP(addr net.Addr) string {
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	return host
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	sshd "github.com/gliderlabs/ssh"
+	"golang.org/x/crypto/ssh"
+	"io"
+	"sync/atomic"
+)
+
+type (
+	// hostKeySet 当前使用的主机密钥，重新加载配置时整体替换
+	hostKeySet struct {
+		signers atomic.Value // []sshd.Signer
+	}
+
+	// hostKeySlot sshd.Server.HostSigners 中的一项，使用主机密钥集合中对应位置的密钥。
+	// sshd 只能通过 AddHostKey 按类型追加或替换密钥，无法删除，
+	// 超出当前密钥数量的位置使用第一个密钥，同类型的密钥在每个连接的配置中会被去重，不会再提供被删除的密钥
+	hostKeySlot struct {
+		set   *hostKeySet
+		index int
+	}
+)
+
+func newHostKeySet(signers []sshd.Signer) *hostKeySet {
+	set := &hostKeySet{}
+	set.signers.Store(signers)
+	return set
+}
+
+// Slots 返回与当前密钥数量相同的 hostKeySlot
+func (set *hostKeySet) Slots() []sshd.Signer {
+	signers := set.signers.Load().([]sshd.Signer)
+	slots := make([]sshd.Signer, 0, len(signers))
+	for i := range signers {
+		slots = append(slots, &hostKeySlot{set: set, index: i})
+	}
+	return slots
+}
+
+// Replace 替换主机密钥，密钥数量比 sshd 中的位置多时为 sshd 追加新的位置
+func (set *hostKeySet) Replace(srv *sshd.Server, signers []sshd.Signer) {
+	set.signers.Store(signers)
+	for i := len(srv.HostSigners); i < len(signers); i++ {
+		srv.AddHostKey(&hostKeySlot{set: set, index: i})
+	}
+}
+
+func (k *hostKeySlot) signer() sshd.Signer {
+	signers := k.set.signers.Load().([]sshd.Signer)
+	if k.index < len(signers) {
+		return signers[k.index]
+	}
+	return signers[0]
+}
+
+func (k *hostKeySlot) PublicKey() ssh.PublicKey {
+	return k.signer().PublicKey()
+}
+
+func (k *hostKeySlot) Sign(rand io.Reader, data []byte) (*ssh.Signature, error) {
+	return k.signer().Sign(rand, data)
+}
+
+// SignWithAlgorithm RSA 密钥需要支持 rsa-sha2-256/512 签名
+func (k *hostKeySlot) SignWithAlgorithm(rand io.Reader, data []byte, algorithm string) (*ssh.Signature, error) {
+	signer := k.signer()
+	if as, ok := signer.(ssh.AlgorithmSigner); ok {
+		return as.SignWithAlgorithm(rand, data, algorithm)
+	}
+	if algorithm != "" && algorithm != signer.PublicKey().Type() {
+		return nil, errors.New(fmt.Sprintf("host key %s does not support algorithm %s", signer.PublicKey().Type(), algorithm))
+	}
+	return signer.Sign(rand, data)
+}
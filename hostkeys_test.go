@@ -0,0 +1,113 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/pem"
+	"golang.org/x/crypto/ssh"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func writeTestHostKey(t *testing.T, name string, key interface{}) string {
+	t.Helper()
+	block, err := ssh.MarshalPrivateKey(key, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	file := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(file, pem.EncodeToMemory(block), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return file
+}
+
+// dialHostKey 只接受指定算法的主机密钥，返回服务端提供的密钥
+func dialHostKey(addr, algorithm string) (ssh.PublicKey, error) {
+	var hostKey ssh.PublicKey
+	client, err := ssh.Dial("tcp", addr, &ssh.ClientConfig{
+		User:              "tools",
+		Auth:              []ssh.AuthMethod{ssh.Password("tools")},
+		HostKeyAlgorithms: []string{algorithm},
+		HostKeyCallback: func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+			hostKey = key
+			return nil
+		},
+		Timeout: 5 * time.Second,
+	})
+	if err != nil {
+		return nil, err
+	}
+	_ = client.Close()
+	return hostKey, nil
+}
+
+// TestReloadHostKeys 重新加载后删除的主机密钥不再提供，替换的密钥立即生效
+func TestReloadHostKeys(t *testing.T) {
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, edKey2, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	edFile := writeTestHostKey(t, "ed25519", edKey)
+	edFile2 := writeTestHostKey(t, "ed25519_2", edKey2)
+	ecFile := writeTestHostKey(t, "ecdsa", ecKey)
+
+	cfg := Config{HostKeys: []string{edFile, ecFile}}
+	s, addr := newTestServer(t, cfg, time.Second)
+	for _, algorithm := range []string{ssh.KeyAlgoED25519, ssh.KeyAlgoECDSA256} {
+		if _, err := dialHostKey(addr, algorithm); err != nil {
+			t.Fatalf("%s: %v", algorithm, err)
+		}
+	}
+
+	s.loader = func() (Config, error) {
+		cfg := Config{HostKeys: []string{edFile2}}
+		cfg.SetDefault()
+		return cfg, nil
+	}
+	if err := s.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := dialHostKey(addr, ssh.KeyAlgoECDSA256); err == nil {
+		t.Fatal("removed ecdsa host key is still offered")
+	}
+	key, err := dialHostKey(addr, ssh.KeyAlgoED25519)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, err := ssh.NewPublicKey(edKey2.Public())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(key.Marshal()) != string(want.Marshal()) {
+		t.Fatal("ed25519 host key was not replaced")
+	}
+
+	// 重新增加密钥时追加新的位置
+	s.loader = func() (Config, error) {
+		cfg := Config{HostKeys: []string{ecFile, edFile, edFile2}}
+		cfg.SetDefault()
+		return cfg, nil
+	}
+	if err := s.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	for _, algorithm := range []string{ssh.KeyAlgoED25519, ssh.KeyAlgoECDSA256} {
+		if _, err := dialHostKey(addr, algorithm); err != nil {
+			t.Fatalf("%s after reload: %v", algorithm, err)
+		}
+	}
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	sshd "github.com/gliderlabs/ssh"
+	"golang.org/x/crypto/ssh"
+	"math/rand"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+type (
+	// LimitsConfig 连接和会话数量限制，0 表示不限制
+	LimitsConfig struct {
+		MaxConnections        int    `json:"MaxConnections"`        // 同时存在的连接总数
+		MaxConnectionsPerUser int    `json:"MaxConnectionsPerUser"` // 同一用户同时存在的已认证连接数
+		MaxSessions           int    `json:"MaxSessions"`           // 每个连接同时打开的会话数，默认 10
+		MaxStartups           string `json:"MaxStartups"`           // 与 OpenSSH 相同的 start:rate:full，未认证连接达到 start 后按 rate% 随机拒绝，达到 full 后全部拒绝
+
+		startups maxStartups // Validate 时解析的 MaxStartups
+	}
+
+	// Limiter 统计连接总数和每个用户的连接数
+	Limiter struct {
+		mu    sync.Mutex
+		conns int
+		users map[string]int
+	}
+
+	// maxStartups 解析后的 MaxStartups
+	maxStartups struct {
+		start, rate, full int
+	}
+)
+
+var (
+	// ctxKeySessions 连接中打开的会话数，*int32
+	ctxKeySessions = &struct{ name string }{"sessions"}
+	// ctxKeyUserLimited 认证成功时用户的连接数已达到上限
+	ctxKeyUserLimited = &struct{ name string }{"user-limited"}
+)
+
+func (c *LimitsConfig) SetDefault() {
+	if c.MaxSessions == 0 {
+		c.MaxSessions = 10
+	}
+	if c.MaxStartups == "" {
+		c.MaxStartups = "10:30:100"
+	}
+}
+
+// Validate 解析 MaxStartups，避免每个连接重复解析
+func (c *LimitsConfig) Validate() error {
+	startups, err := parseMaxStartups(c.MaxStartups)
+	if err != nil {
+		return err
+	}
+	c.startups = startups
+	return nil
+}
+
+// parseMaxStartups 支持 full 或 start:rate:full 两种格式
+func parseMaxStartups(s string) (maxStartups, error) {
+	parts := strings.Split(s, ":")
+	nums := make([]int, 0, len(parts))
+	for _, part := range parts {
+		n, err := strconv.Atoi(part)
+		if err != nil || n < 0 {
+			return maxStartups{}, errors.New(fmt.Sprintf("invalid MaxStartups %q", s))
+		}
+		nums = append(nums, n)
+	}
+	switch len(nums) {
+	case 1:
+		return maxStartups{start: nums[0], rate: 100, full: nums[0]}, nil
+	case 3:
+		if nums[0] > nums[2] || nums[1] > 100 {
+			return maxStartups{}, errors.New(fmt.Sprintf("invalid MaxStartups %q", s))
+		}
+		return maxStartups{start: nums[0], rate: nums[1], full: nums[2]}, nil
+	default:
+		return maxStartups{}, errors.New(fmt.Sprintf("invalid MaxStartups %q", s))
+	}
+}
+
+// Drop 按当前未认证连接数决定是否拒绝新连接，拒绝概率从 start 时的 rate% 线性增加到 full 时的 100%
+func (m maxStartups) Drop(pending int) bool {
+	if m.full == 0 || pending < m.start {
+		return false
+	}
+	if pending >= m.full {
+		return true
+	}
+	rate := m.rate + (100-m.rate)*(pending-m.start)/(m.full-m.start)
+	return rand.Intn(100) < rate
+}
+
+func NewLimiter() *Limiter {
+	return &Limiter{users: make(map[string]int)}
+}
+
+// AcquireConn 连接数未达到上限时占用一个名额，返回释放函数，达到上限时返回 nil
+func (l *Limiter) AcquireConn(max int) func() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if max > 0 && l.conns >= max {
+		return nil
+	}
+	l.conns++
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			l.mu.Lock()
+			defer l.mu.Unlock()
+			l.conns--
+		})
+	}
+}
+
+// AcquireUser 用户的连接数未达到上限时占用一个名额，返回释放函数，达到上限时返回 nil
+func (l *Limiter) AcquireUser(user string, max int) func() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if max > 0 && l.users[user] >= max {
+		return nil
+	}
+	l.users[user]++
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			l.mu.Lock()
+			defer l.mu.Unlock()
+			if l.users[user]--; l.users[user] <= 0 {
+				delete(l.users, user)
+			}
+		})
+	}
+}
+
+// MaxConnectionsPerUser 账号中的设置优先
+func (c *Config) MaxConnectionsPerUser(user string) int {
+	if account := c.LookupAccount(user); account != nil && account.MaxConnections != 0 {
+		return account.MaxConnections
+	}
+	return c.Limits.MaxConnectionsPerUser
+}
+
+// limitUser 认证成功后占用用户的连接名额，连接关闭时释放。
+// 超过上限时认证仍然成功，在打开会话时拒绝并说明原因，避免被当作密码错误计入暴力破解
+func (s *Server) limitUser(ctx sshd.Context, user string) {
+	cfg := s.Config()
+	release := s.limiter.AcquireUser(user, cfg.MaxConnectionsPerUser(user))
+	if release == nil {
+		metrics.ConnectionsRejected.Add(1, "user-limit")
+		s.log.Warn("connection rejected", "session", shortSessionID(ctx), "user", user,
+			"remote", ctx.RemoteAddr().String(), "reason", "user-limit")
+		ctx.SetValue(ctxKeyUserLimited, true)
+		return
+	}
+	// 不能在新的 goroutine 中等待 ctx.Done()，握手过程中的 SetValue 会与之并发
+	act, _ := ctx.Value(ctxKeyActivity).(*connActivity)
+	act.OnClose(release)
+}
+
+// userLimited 用户的连接数超过上限时拒绝 channel 并关闭连接
+func (s *Server) userLimited(ctx sshd.Context, conn *ssh.ServerConn, newChan ssh.NewChannel) bool {
+	if limited, _ := ctx.Value(ctxKeyUserLimited).(bool); !limited {
+		return false
+	}
+	_ = newChan.Reject(ssh.ResourceShortage, fmt.Sprintf("too many connections for user %s", ctx.User()))
+	_ = conn.Close()
+	return true
+}
+
+// acquireSession 检查连接的会话数，超过限制时拒绝 channel 并返回 nil
+func (s *Server) acquireSession(ctx sshd.Context, conn *ssh.ServerConn, newChan ssh.NewChannel) func() {
+	if s.userLimited(ctx, conn, newChan) {
+		return nil
+	}
+	sessions, ok := ctx.Value(ctxKeySessions).(*int32)
+	if !ok {
+		return func() {}
+	}
+	max := s.Config().Limits.MaxSessions
+	if n := atomic.AddInt32(sessions, 1); max > 0 && int(n) > max {
+		atomic.AddInt32(sessions, -1)
+		metrics.SessionsRejected.Add(1, "max-sessions")
+		s.log.Warn("session rejected", "session", shortSessionID(ctx), "user", ctx.User(), "reason", "max-sessions", "max", max)
+		_ = newChan.Reject(ssh.ResourceShortage, fmt.Sprintf("too many sessions, at most %d per connection", max))
+		return nil
+	}
+	return func() {
+		atomic.AddInt32(sessions, -1)
+	}
+}
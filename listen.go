@@ -0,0 +1,134 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	sshd "github.com/gliderlabs/ssh"
+	"net"
+	"os"
+	"strings"
+)
+
+const (
+	AuthMethodPassword  = "password"
+	AuthMethodPublicKey = "publickey"
+	// AuthMethodKeyboardInteractive 仅用于输入 TOTP 验证码
+	AuthMethodKeyboardInteractive = "keyboard-interactive"
+)
+
+type (
+	// ListenAddr 监听地址，支持 host:port、[v6]:port 以及 unix socket 路径
+	ListenAddr struct {
+		Address     string   `json:"Address"`
+		Name        string   `json:"Name"`        // systemd socket 的 FileDescriptorName，用于匹配继承的监听
+		AuthMethods []string `json:"AuthMethods"` // 该地址允许的认证方式，为空表示不限制
+	}
+
+	// listenerConn 记录连接来自哪个监听地址
+	listenerConn struct {
+		net.Conn
+		addr *ListenAddr
+	}
+	addrListener struct {
+		net.Listener
+		addr *ListenAddr
+	}
+)
+
+var ctxKeyListenAddr = &struct{ name string }{"listen-addr"}
+
+// ListenAddrs 返回需要监听的地址，未配置 Listen 时监听 *:Port
+func (c *Config) ListenAddrs() []ListenAddr {
+	if len(c.Listen) > 0 {
+		return c.Listen
+	}
+	return []ListenAddr{{Address: fmt.Sprintf(":%d", c.Port)}}
+}
+
+func (a ListenAddr) network() (network, address string) {
+	switch {
+	case strings.HasPrefix(a.Address, "unix:"):
+		return "unix", strings.TrimPrefix(a.Address, "unix:")
+	case strings.HasPrefix(a.Address, "/"), strings.HasPrefix(a.Address, "./"):
+		return "unix", a.Address
+	}
+	return "tcp", a.Address
+}
+
+// AllowAuth 判断该地址是否允许某种认证方式
+func (a *ListenAddr) AllowAuth(method string) bool {
+	if a == nil || len(a.AuthMethods) == 0 {
+		return true
+	}
+	for _, m := range a.AuthMethods {
+		if strings.EqualFold(m, method) {
+			return true
+		}
+	}
+	return false
+}
+
+// Listen 按配置监听所有地址，任一失败则关闭已打开的监听
+func Listen(addrs []ListenAddr, log Logger) ([]net.Listener, error) {
+	listeners := make([]net.Listener, 0, len(addrs))
+	for i := range addrs {
+		addr := &addrs[i]
+		network, address := addr.network()
+		if network == "unix" {
+			// 清理上次残留的 socket 文件
+			if info, err := os.Lstat(address); err == nil && info.Mode()&os.ModeSocket != 0 {
+				_ = os.Remove(address)
+			}
+		}
+		l, err := net.Listen(network, address)
+		if err != nil {
+			for _, opened := range listeners {
+				_ = opened.Close()
+			}
+			return nil, errors.New(fmt.Sprintf("listen %s err:%s", addr.Address, err.Error()))
+		}
+		log.Info("listen", "network", network, "addr", l.Addr().String())
+		listeners = append(listeners, &addrListener{Listener: l, addr: addr})
+	}
+	return listeners, nil
+}
+
+// matchListenAddr 按 socket 名称或地址为继承的监听匹配配置，匹配不到时返回 nil
+func matchListenAddr(addrs []ListenAddr, name string, l net.Listener) *ListenAddr {
+	for i := range addrs {
+		if name != "" && addrs[i].Name == name {
+			return &addrs[i]
+		}
+	}
+	for i := range addrs {
+		_, address := addrs[i].network()
+		if address == l.Addr().String() {
+			return &addrs[i]
+		}
+	}
+	return nil
+}
+
+// restrictsAuth 是否有地址限制了认证方式
+func restrictsAuth(addrs []ListenAddr) bool {
+	for _, addr := range addrs {
+		if len(addr.AuthMethods) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+func (l *addrListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &listenerConn{Conn: conn, addr: l.addr}, nil
+}
+
+// connListenAddr 取出连接对应的监听地址配置，可能为 nil
+func connListenAddr(ctx sshd.Context) *ListenAddr {
+	addr, _ := ctx.Value(ctxKeyListenAddr).(*ListenAddr)
+	return addr
+}
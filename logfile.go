@@ -0,0 +1,91 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sync"
+)
+
+type (
+	// RotateWriter 按大小切割的日志文件，历史文件命名为 file.1 file.2 ...
+	RotateWriter struct {
+		mu         sync.Mutex
+		file       string
+		maxSize    int64
+		maxBackups int
+		f          *os.File
+		size       int64
+	}
+)
+
+func NewRotateWriter(file string, maxSize int64, maxBackups int) (*RotateWriter, error) {
+	w := &RotateWriter{
+		file:       file,
+		maxSize:    maxSize,
+		maxBackups: maxBackups,
+	}
+	if err := w.open(); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+func (w *RotateWriter) open() error {
+	f, err := os.OpenFile(w.file, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		_ = f.Close()
+		return err
+	}
+	w.f = f
+	w.size = info.Size()
+	return nil
+}
+
+func (w *RotateWriter) Write(p []byte) (n int, err error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.f == nil {
+		return 0, os.ErrClosed
+	}
+	if w.maxSize > 0 && w.size > 0 && w.size+int64(len(p)) > w.maxSize {
+		if err := w.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	n, err = w.f.Write(p)
+	w.size += int64(n)
+	return n, err
+}
+
+func (w *RotateWriter) rotate() error {
+	_ = w.f.Close()
+	w.f = nil
+	for i := w.maxBackups; i > 0; i-- {
+		src := w.file
+		if i > 1 {
+			src = fmt.Sprintf("%s.%d", w.file, i-1)
+		}
+		dst := fmt.Sprintf("%s.%d", w.file, i)
+		_ = os.Remove(dst)
+		_ = os.Rename(src, dst)
+	}
+	if w.maxBackups <= 0 {
+		_ = os.Remove(w.file)
+	}
+	return w.open()
+}
+
+func (w *RotateWriter) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.f == nil {
+		return nil
+	}
+	err := w.f.Close()
+	w.f = nil
+	return err
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	sshd "github.com/gliderlabs/ssh"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	LogLevelDebug LogLevel = iota - 1
+	LogLevelInfo
+	LogLevelWarn
+	LogLevelError
+)
+
+type (
+	// Logger 结构化日志接口，args 为成对的 key、value
+	Logger interface {
+		Debug(msg string, args ...interface{})
+		Info(msg string, args ...interface{})
+		Warn(msg string, args ...interface{})
+		Error(msg string, args ...interface{})
+		// With 返回附带了固定字段的 Logger
+		With(args ...interface{}) Logger
+	}
+
+	LogLevel int32
+
+	LogConfig struct {
+		Level  string `json:"Level"`  // debug、info、warn、error
+		Format string `json:"Format"` // text、json
+	}
+
+	// StdLogger 默认实现，输出 text 或 json 行
+	StdLogger struct {
+		core  *logCore
+		attrs []interface{}
+	}
+	logCore struct {
+		mu    sync.Mutex
+		w     io.Writer
+		json  bool
+		level int32
+	}
+)
+
+func (c *LogConfig) SetDefault() {
+	if c.Level == "" {
+		c.Level = "info"
+	}
+	if c.Format == "" {
+		c.Format = "text"
+	}
+}
+
+func ParseLogLevel(level string) LogLevel {
+	switch strings.ToLower(level) {
+	case "debug":
+		return LogLevelDebug
+	case "warn", "warning":
+		return LogLevelWarn
+	case "error":
+		return LogLevelError
+	}
+	return LogLevelInfo
+}
+
+func (l LogLevel) String() string {
+	switch l {
+	case LogLevelDebug:
+		return "DEBUG"
+	case LogLevelWarn:
+		return "WARN"
+	case LogLevelError:
+		return "ERROR"
+	}
+	return "INFO"
+}
+
+func NewLogger(w io.Writer, cfg LogConfig) *StdLogger {
+	return &StdLogger{
+		core: &logCore{
+			w:     w,
+			json:  strings.EqualFold(cfg.Format, "json"),
+			level: int32(ParseLogLevel(cfg.Level)),
+		},
+	}
+}
+
+// SetLevel 修改日志级别，对所有 With 派生的 Logger 生效
+func (l *StdLogger) SetLevel(level string) {
+	atomic.StoreInt32(&l.core.level, int32(ParseLogLevel(level)))
+}
+
+func (l *StdLogger) Debug(msg string, args ...interface{}) {
+	l.log(LogLevelDebug, msg, args)
+}
+
+func (l *StdLogger) Info(msg string, args ...interface{}) {
+	l.log(LogLevelInfo, msg, args)
+}
+
+func (l *StdLogger) Warn(msg string, args ...interface{}) {
+	l.log(LogLevelWarn, msg, args)
+}
+
+func (l *StdLogger) Error(msg string, args ...interface{}) {
+	l.log(LogLevelError, msg, args)
+}
+
+func (l *StdLogger) With(args ...interface{}) Logger {
+	attrs := make([]interface{}, 0, len(l.attrs)+len(args))
+	attrs = append(attrs, l.attrs...)
+	attrs = append(attrs, args...)
+	return &StdLogger{core: l.core, attrs: attrs}
+}
+
+func (l *StdLogger) log(level LogLevel, msg string, args []interface{}) {
+	if int32(level) < atomic.LoadInt32(&l.core.level) {
+		return
+	}
+	kvs := make([]interface{}, 0, len(l.attrs)+len(args))
+	kvs = append(kvs, l.attrs...)
+	kvs = append(kvs, args...)
+	if len(kvs)%2 != 0 {
+		kvs = append(kvs, "!MISSING")
+	}
+	now := time.Now()
+
+	buf := &bytes.Buffer{}
+	if l.core.json {
+		buf.WriteString(`{"time":`)
+		writeJSON(buf, now.Format(time.RFC3339Nano))
+		buf.WriteString(`,"level":`)
+		writeJSON(buf, level.String())
+		buf.WriteString(`,"msg":`)
+		writeJSON(buf, msg)
+		for i := 0; i < len(kvs); i += 2 {
+			buf.WriteByte(',')
+			writeJSON(buf, fmt.Sprint(kvs[i]))
+			buf.WriteByte(':')
+			writeJSON(buf, logValue(kvs[i+1]))
+		}
+		buf.WriteString("}\n")
+	} else {
+		buf.WriteString(now.Format("2006-01-02T15:04:05.000Z07:00"))
+		buf.WriteByte(' ')
+		buf.WriteString(level.String())
+		buf.WriteByte(' ')
+		buf.WriteString(textValue(msg))
+		for i := 0; i < len(kvs); i += 2 {
+			buf.WriteByte(' ')
+			buf.WriteString(fmt.Sprint(kvs[i]))
+			buf.WriteByte('=')
+			buf.WriteString(textValue(fmt.Sprint(logValue(kvs[i+1]))))
+		}
+		buf.WriteByte('\n')
+	}
+
+	l.core.mu.Lock()
+	defer l.core.mu.Unlock()
+	_, _ = l.core.w.Write(buf.Bytes())
+}
+
+func logValue(v interface{}) interface{} {
+	switch val := v.(type) {
+	case error:
+		return val.Error()
+	case fmt.Stringer:
+		return val.String()
+	case time.Duration:
+		return val.String()
+	}
+	return v
+}
+
+func writeJSON(buf *bytes.Buffer, v interface{}) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		data, _ = json.Marshal(fmt.Sprint(v))
+	}
+	buf.Write(data)
+}
+
+func textValue(s string) string {
+	if s == "" || strings.ContainsAny(s, " \t\r\n\"=") {
+		return strconv.Quote(s)
+	}
+	return s
+}
+
+// sessionLogger 返回附带会话信息的 Logger
+func sessionLogger(log Logger, sess sshd.Session, subsystem string) Logger {
+	ctx := sess.Context()
+	return log.With("session", shortSessionID(ctx), "user", ctx.User(), "remote", ctx.RemoteAddr().String(), "subsystem", subsystem)
+}
+
+// shortSessionID 会话 hash 的前 12 位，用于日志和审计关联，握手完成前为空
+func shortSessionID(ctx sshd.Context) string {
+	// 握手完成前 ctx.SessionID() 会 panic
+	id, _ := ctx.Value(sshd.ContextKeySessionID).(string)
+	if len(id) > 12 {
+		id = id[:12]
+	}
+	return id
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	sshd "github.com/gliderlabs/ssh"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+type (
+	// LoginConfig 登录提示信息配置
+	LoginConfig struct {
+		Banner         string `json:"Banner"`         // 认证前发送给客户端的提示，如法律声明
+		BannerFile     string `json:"BannerFile"`     // 从文件读取认证前提示，优先于 Banner
+		MOTDFile       string `json:"MOTDFile"`       // 交互式登录时在 shell 启动前显示的文件
+		LastLogFile    string `json:"LastLogFile"`    // 保存每个用户最近一次登录的时间和来源
+		DisableLastLog bool   `json:"DisableLastLog"` // 不记录也不显示 Last login
+	}
+
+	// LastLogin 用户最近一次登录的信息
+	LastLogin struct {
+		Time time.Time `json:"Time"`
+		From string    `json:"From"`
+	}
+
+	// LoginHistory 以 JSON 文件保存每个用户最近一次的登录
+	LoginHistory struct {
+		mu sync.Mutex
+	}
+)
+
+func (c *LoginConfig) SetDefault() {
+	if c.LastLogFile == "" {
+		c.LastLogFile = "./ssh_toolkits_lastlog.json"
+	}
+}
+
+// BannerText 返回认证前提示，每次连接重新读取文件，修改后无需重启
+func (c *LoginConfig) BannerText() (string, error) {
+	if c.BannerFile == "" {
+		return normalizeBanner(c.Banner), nil
+	}
+	data, err := os.ReadFile(c.BannerFile)
+	if err != nil {
+		return normalizeBanner(c.Banner), err
+	}
+	return normalizeBanner(string(data)), nil
+}
+
+// normalizeBanner 客户端原样输出 banner，统一使用 \r\n 换行并保证以换行结尾
+func normalizeBanner(text string) string {
+	if text == "" {
+		return ""
+	}
+	text = strings.ReplaceAll(strings.ReplaceAll(text, "\r\n", "\n"), "\n", "\r\n")
+	if !strings.HasSuffix(text, "\r\n") {
+		text += "\r\n"
+	}
+	return text
+}
+
+// Record 记录用户本次登录，返回上一次登录的信息
+func (h *LoginHistory) Record(cfg LoginConfig, user, from string, now time.Time) (*LastLogin, error) {
+	if cfg.DisableLastLog {
+		return nil, nil
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	history, err := loadLoginHistory(cfg.LastLogFile)
+	if err != nil {
+		return nil, err
+	}
+	var prev *LastLogin
+	if last, ok := history[user]; ok {
+		prev = &last
+	}
+	history[user] = LastLogin{Time: now, From: from}
+	return prev, saveLoginHistory(cfg.LastLogFile, history)
+}
+
+func loadLoginHistory(file string) (map[string]LastLogin, error) {
+	history := make(map[string]LastLogin)
+	data, err := os.ReadFile(file)
+	if errors.Is(err, os.ErrNotExist) {
+		return history, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err = json.Unmarshal(data, &history); err != nil {
+		return nil, errors.New(fmt.Sprintf("parse %s err:%s", file, err.Error()))
+	}
+	return history, nil
+}
+
+// saveLoginHistory 先写临时文件再改名，避免进程退出时留下不完整的文件
+func saveLoginHistory(file string, history map[string]LastLogin) error {
+	data, err := json.MarshalIndent(history, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(file), filepath.Base(file)+".*")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(data)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		_ = os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), file)
+}
+
+// recordLogin 交互式 shell 登录时记录登录历史，返回上一次的登录信息，首次登录或出错时返回 nil。
+// exec、scp、sftp 不记录，与 OpenSSH 的 lastlog 相同
+func (h *SSH) recordLogin(sess sshd.Session, log Logger) *LastLogin {
+	last, err := h.srv.history.Record(h.srv.Config().Login, sess.User(), remoteIP(sess.RemoteAddr()), time.Now())
+	if err != nil {
+		log.Warn("record login history failed", "err", err)
+		return nil
+	}
+	return last
+}
+
+// writeLoginMessage 在交互式 shell 启动前输出 MOTD 和上次登录信息，pty 中需要 \r\n 换行
+func writeLoginMessage(w io.Writer, cfg LoginConfig, last *LastLogin) error {
+	var b strings.Builder
+	if cfg.MOTDFile != "" {
+		data, err := os.ReadFile(cfg.MOTDFile)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		b.Write(data)
+		if len(data) > 0 && data[len(data)-1] != '\n' {
+			b.WriteByte('\n')
+		}
+	}
+	if last != nil && !cfg.DisableLastLog {
+		b.WriteString(fmt.Sprintf("Last login: %s from %s\n", last.Time.Local().Format("Mon Jan _2 15:04:05 2006"), last.From))
+	}
+	if b.Len() == 0 {
+		return nil
+	}
+	_, err := io.WriteString(w, strings.ReplaceAll(strings.ReplaceAll(b.String(), "\r\n", "\n"), "\n", "\r\n"))
+	return err
+}
@@ -1,110 +1,172 @@
 package main
 
 import (
-	"bytes"
+	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
-	sshd "github.com/gliderlabs/ssh"
-	"golang.org/x/crypto/ssh"
-	"net"
+	"io/fs"
+	"os"
 	"time"
 )
 
 func main() {
+	// 作为会话命令的启动器运行时不会返回
+	RunProcLimits()
+
 	var (
-		port     uint = 4400
-		username      = "tools"
-		password      = "tools"
-		cfgPath       = "./ssh_toolkits_cfg.json"
+		port        uint = 4400
+		username         = "tools"
+		password         = "tools"
+		cfgPath          = "./ssh_toolkits_cfg.json"
+		printConfig      = false
+		daemon           = false
+		pidFile          = ""
+		logFile          = ""
+		logLevel         = ""
 	)
 
 	flag.UintVar(&port, "port", 4400, "the listen port")
 	flag.StringVar(&username, "username", "tools", "the ssh auth username")
 	flag.StringVar(&password, "password", "tools", "the ssh auth password")
 	flag.StringVar(&cfgPath, "config", cfgPath, "the config file")
+	flag.BoolVar(&printConfig, "print-config", false, "print the effective config and exit")
+	flag.BoolVar(&daemon, "daemon", false, "run in background, logs go to the log file")
+	flag.StringVar(&pidFile, "pidfile", "./ssh_toolkits.pid", "the pid file used by -daemon, status and stop")
+	flag.StringVar(&logFile, "log-file", "./ssh_toolkits.log", "the log file used by -daemon")
+	flag.StringVar(&logLevel, "log-level", "info", "the log level: debug, info, warn, error")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [options] [status|stop|totp-enroll [username]]\n", os.Args[0])
+		flag.PrintDefaults()
+	}
 	flag.Parse()
-	//解析配置文件
-	cfg, err := LoadConfig(cfgPath)
-	if err != nil {
-		fmt.Printf("load config file err:%s\n", err.Error())
-		cfg.SetDefault()
+
+	// 只有显式指定的命令行参数才覆盖配置
+	setFlags := map[string]bool{}
+	flag.Visit(func(f *flag.Flag) {
+		setFlags[f.Name] = true
+	})
+	if v, ok := os.LookupEnv(EnvPrefix + "CONFIG"); ok && !setFlags["config"] {
+		cfgPath = v
 	}
-	if username != "" && username != "tools" {
-		cfg.Account.Username = username
+	override := func(cfg *Config) {
+		if setFlags["username"] {
+			cfg.Account.Username = username
+		}
+		if setFlags["password"] {
+			cfg.Account.Password = password
+		}
+		if setFlags["port"] {
+			cfg.Port = uint16(port)
+		}
+		if setFlags["pidfile"] {
+			cfg.Daemon.PidFile = pidFile
+		}
+		if setFlags["log-file"] {
+			cfg.Daemon.LogFile = logFile
+		}
+		if setFlags["log-level"] {
+			cfg.Log.Level = logLevel
+		}
 	}
-	if password != "" && password != "tools" {
-		cfg.Account.Password = password
+	loader := func() (Config, error) {
+		//解析配置文件
+		return BuildConfig(cfgPath, os.Environ(), override)
 	}
-	if port != 4400 {
-		cfg.Port = uint16(port)
+	cfg, err := loader()
+	// 配置文件不存在时使用默认值，存在但解析失败时不能带着默认账号启动
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		fmt.Printf("load config %s failed: %s\n", cfgPath, err.Error())
+		os.Exit(1)
 	}
-
-	fmt.Printf("listen at *:%d\n", port)
-	l, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
-	if err != nil {
-		panic(err)
+	if printConfig {
+		data, _ := json.MarshalIndent(cfg.Redacted(), "", "  ")
+		fmt.Println(string(data))
+		return
 	}
 
-	signer, _ := ssh.ParsePrivateKey([]byte(PRIKEY))
-	srv := &sshd.Server{
-		Addr:                       "",
-		Handler:                    (&SSH{}).Handle,
-		HostSigners:                []sshd.Signer{signer},
-		Version:                    "toolkits",
-		KeyboardInteractiveHandler: nil,
-		PasswordHandler: func(ctx sshd.Context, password string) bool {
-			if ctx.User() == username && password == password {
-				return true
-			}
-			return false
-		},
-		PublicKeyHandler: func(ctx sshd.Context, key sshd.PublicKey) bool {
-			pk, _, _, _, err := ssh.ParseAuthorizedKey([]byte(PUBKEY))
-			if err != nil {
-				panic(err)
-			}
-			if bytes.Equal(key.Marshal(), pk.Marshal()) {
-				return true
-			}
-			return false
-		},
-		LocalPortForwardingCallback:   nil,
-		ReversePortForwardingCallback: nil,
-		ServerConfigCallback:          getServerConfigCallback(cfg),
-		SessionRequestCallback:        nil,
-		ConnectionFailedCallback:      nil,
-		IdleTimeout:                   time.Hour * 12,
-		MaxTimeout:                    time.Hour * 12,
-		ChannelHandlers:               nil,
-		RequestHandlers:               nil,
-		SubsystemHandlers:             nil,
+	switch flag.Arg(0) {
+	case "":
+	case "status":
+		if err := DaemonStatus(cfg.Daemon); err != nil {
+			fmt.Println(err.Error())
+			os.Exit(1)
+		}
+		return
+	case "stop":
+		if err := StopDaemon(cfg.Daemon, time.Duration(cfg.ShutdownTimeout+5)*time.Second); err != nil {
+			fmt.Println(err.Error())
+			os.Exit(1)
+		}
+		return
+	case "totp-enroll":
+		// 为指定账号生成新的 TOTP 密钥，默认为主账号，写入该账号的 TOTPSecret 后生效
+		user := cfg.Account.Username
+		if flag.NArg() > 1 {
+			user = flag.Arg(1)
+		}
+		account := cfg.LookupAccount(user)
+		if account == nil {
+			fmt.Printf("account %s not found in %s\n", user, cfgPath)
+			os.Exit(1)
+		}
+		secret, err := NewTOTPSecret()
+		if err != nil {
+			fmt.Println(err.Error())
+			os.Exit(1)
+		}
+		fmt.Printf("secret: %s\nuri: %s\n", secret, TOTPURI(secret, account.Username))
+		if account == &cfg.Account {
+			fmt.Printf("set Account.TOTPSecret to the secret in %s or %sTOTP_SECRET, then reload\n", cfgPath, EnvPrefix)
+		} else {
+			fmt.Printf("set TOTPSecret of account %s in Accounts of %s to the secret, then reload\n", account.Username, cfgPath)
+		}
+		return
+	default:
+		flag.Usage()
+		os.Exit(2)
 	}
-	initSubsystemHandler(srv)
 
-	err = srv.Serve(l)
+	log := NewLogger(os.Stdout, cfg.Log)
 	if err != nil {
-		fmt.Printf("%+v\n", err)
+		log.Warn("config file not found, using defaults", "file", cfgPath, "err", err)
+	}
+	if err := cfg.Validate(); err != nil {
+		log.Error("invalid config", "file", cfgPath, "err", err)
+		os.Exit(1)
 	}
-}
 
-func initSubsystemHandler(srv *sshd.Server) {
-	srv.SubsystemHandlers = map[string]sshd.SubsystemHandler{
-		"sftp": NewSFTPServer().Handle,
+	if daemon && daemonRole() != daemonRoleWorker {
+		if daemonRole() == daemonRoleSupervisor {
+			err = RunSupervisor(cfg.Daemon, cfg.Log)
+		} else {
+			err = StartDaemon(cfg.Daemon)
+		}
+		if err != nil {
+			fmt.Println(err.Error())
+			os.Exit(1)
+		}
+		return
 	}
-}
 
-func getServerConfigCallback(cfg Config) sshd.ServerConfigCallback {
-	if cfg.ServerConfig == nil {
-		return nil
+	// 优先使用 systemd 传入的监听
+	listeners, err := InheritedListeners(cfg.ListenAddrs(), log)
+	if err != nil {
+		panic(err)
 	}
-	return func(ctx sshd.Context) *ssh.ServerConfig {
-		return &ssh.ServerConfig{
-			Config: ssh.Config{
-				KeyExchanges: cfg.ServerConfig.KeyExchanges,
-				Ciphers:      cfg.ServerConfig.Ciphers,
-				MACs:         cfg.ServerConfig.MACs,
-			},
-			MaxAuthTries: cfg.ServerConfig.MaxAuthTries,
+	if len(listeners) == 0 {
+		listeners, err = Listen(cfg.ListenAddrs(), log)
+		if err != nil {
+			panic(err)
 		}
 	}
+
+	srv, err := NewServer(cfg, loader, log)
+	if err != nil {
+		panic(err)
+	}
+	err = srv.Serve(listeners)
+	if err != nil {
+		log.Error("server stopped", "err", err)
+	}
 }
@@ -0,0 +1,268 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	SessionTypeShell   = "shell"
+	SessionTypeExec    = "exec"
+	SessionTypeSCP     = "scp"
+	SessionTypeSFTP    = "sftp"
+	SessionTypeForward = "forward"
+
+	TransferUpload   = "upload"
+	TransferDownload = "download"
+)
+
+type (
+	MetricsConfig struct {
+		Listen string `json:"Listen"` // 指标 HTTP 监听地址，如 127.0.0.1:9122，为空时不开启
+	}
+
+	// Metrics 以 Prometheus 文本格式输出的指标集合
+	Metrics struct {
+		ConnectionsTotal    *metricVec
+		ConnectionsActive   *metricVec
+		ConnectionsRejected *metricVec
+		Bans                *metricVec
+		SessionsTotal       *metricVec
+		SessionsActive      *metricVec
+		SessionsRejected    *metricVec
+		AuthAttempts        *metricVec
+		TransferBytes       *metricVec
+		HandshakeSeconds    *histogramVec
+		CommandSeconds      *histogramVec
+
+		all []metricWriter
+	}
+
+	metricWriter interface {
+		writeTo(w io.Writer)
+	}
+
+	// metricVec 带标签的 counter 或 gauge
+	metricVec struct {
+		name   string
+		help   string
+		typ    string
+		labels []string
+		mu     sync.Mutex
+		values map[string]float64
+	}
+
+	histogramVec struct {
+		name    string
+		help    string
+		labels  []string
+		buckets []float64
+		mu      sync.Mutex
+		values  map[string]*histogram
+	}
+	histogram struct {
+		counts []uint64
+		sum    float64
+		count  uint64
+	}
+)
+
+var (
+	defaultBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30, 60, 300, 1800, 3600}
+
+	metrics = NewMetrics()
+)
+
+func NewMetrics() *Metrics {
+	m := &Metrics{
+		ConnectionsTotal:    newMetricVec("ssh_toolkits_connections_total", "Total number of accepted connections.", "counter"),
+		ConnectionsActive:   newMetricVec("ssh_toolkits_connections_active", "Number of open connections.", "gauge"),
+		ConnectionsRejected: newMetricVec("ssh_toolkits_connections_rejected_total", "Connections rejected by reason.", "counter", "reason"),
+		Bans:                newMetricVec("ssh_toolkits_bans_total", "Temporary bans by kind.", "counter", "kind"),
+		SessionsTotal:       newMetricVec("ssh_toolkits_sessions_total", "Total number of sessions by type.", "counter", "type"),
+		SessionsActive:      newMetricVec("ssh_toolkits_sessions_active", "Number of running sessions by type.", "gauge", "type"),
+		SessionsRejected:    newMetricVec("ssh_toolkits_sessions_rejected_total", "Sessions rejected by reason.", "counter", "reason"),
+		AuthAttempts:        newMetricVec("ssh_toolkits_auth_attempts_total", "Authentication attempts by method and result.", "counter", "method", "result"),
+		TransferBytes:       newMetricVec("ssh_toolkits_transfer_bytes_total", "Bytes transferred by SCP and SFTP.", "counter", "protocol", "direction"),
+		HandshakeSeconds:    newHistogramVec("ssh_toolkits_handshake_duration_seconds", "Time from accept to successful authentication.", defaultBuckets),
+		CommandSeconds:      newHistogramVec("ssh_toolkits_command_duration_seconds", "Duration of sessions by type.", defaultBuckets, "type"),
+	}
+	for _, typ := range []string{SessionTypeShell, SessionTypeExec, SessionTypeSCP, SessionTypeSFTP, SessionTypeForward} {
+		m.SessionsActive.Add(0, typ)
+		m.SessionsTotal.Add(0, typ)
+	}
+	m.ConnectionsTotal.Add(0)
+	m.ConnectionsActive.Add(0)
+	m.all = []metricWriter{
+		m.ConnectionsTotal, m.ConnectionsActive, m.ConnectionsRejected, m.Bans, m.SessionsTotal, m.SessionsActive, m.SessionsRejected,
+		m.AuthAttempts, m.TransferBytes, m.HandshakeSeconds, m.CommandSeconds,
+	}
+	return m
+}
+
+// SessionStart 记录会话开始，返回的函数在会话结束时调用
+func (m *Metrics) SessionStart(typ string) func() {
+	start := time.Now()
+	m.SessionsTotal.Add(1, typ)
+	m.SessionsActive.Add(1, typ)
+	return func() {
+		m.SessionsActive.Add(-1, typ)
+		m.CommandSeconds.Observe(time.Since(start).Seconds(), typ)
+	}
+}
+
+func (m *Metrics) Write(w io.Writer) {
+	for _, item := range m.all {
+		item.writeTo(w)
+	}
+}
+
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	buf := &bytes.Buffer{}
+	m.Write(buf)
+	_, _ = w.Write(buf.Bytes())
+}
+
+// ServeMetrics 在 addr 上提供 /metrics，ctx 结束时关闭
+func ServeMetrics(ctx context.Context, addr string, log Logger) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", metrics)
+	srv := &http.Server{
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	go func() {
+		<-ctx.Done()
+		_ = srv.Close()
+	}()
+	log.Info("metrics listen", "addr", l.Addr().String())
+	go func() {
+		if err := srv.Serve(l); err != nil && err != http.ErrServerClosed {
+			log.Error("metrics serve failed", "err", err)
+		}
+	}()
+	return nil
+}
+
+func newMetricVec(name, help, typ string, labels ...string) *metricVec {
+	return &metricVec{
+		name:   name,
+		help:   help,
+		typ:    typ,
+		labels: labels,
+		values: make(map[string]float64),
+	}
+}
+
+func (v *metricVec) Add(delta float64, labelValues ...string) {
+	key := strings.Join(labelValues, "\xff")
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.values[key] += delta
+}
+
+func (v *metricVec) writeTo(w io.Writer) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", v.name, v.help, v.name, v.typ)
+	for _, key := range sortedKeys(v.values) {
+		fmt.Fprintf(w, "%s%s %s\n", v.name, formatLabels(v.labels, key, "", ""), formatFloat(v.values[key]))
+	}
+}
+
+func newHistogramVec(name, help string, buckets []float64, labels ...string) *histogramVec {
+	return &histogramVec{
+		name:    name,
+		help:    help,
+		labels:  labels,
+		buckets: buckets,
+		values:  make(map[string]*histogram),
+	}
+}
+
+func (v *histogramVec) Observe(value float64, labelValues ...string) {
+	key := strings.Join(labelValues, "\xff")
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	h := v.values[key]
+	if h == nil {
+		h = &histogram{counts: make([]uint64, len(v.buckets))}
+		v.values[key] = h
+	}
+	for i, bound := range v.buckets {
+		if value <= bound {
+			h.counts[i]++
+		}
+	}
+	h.sum += value
+	h.count++
+}
+
+func (v *histogramVec) writeTo(w io.Writer) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", v.name, v.help, v.name)
+	keys := make([]string, 0, len(v.values))
+	for key := range v.values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		h := v.values[key]
+		for i, bound := range v.buckets {
+			fmt.Fprintf(w, "%s_bucket%s %d\n", v.name, formatLabels(v.labels, key, "le", formatFloat(bound)), h.counts[i])
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", v.name, formatLabels(v.labels, key, "le", "+Inf"), h.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", v.name, formatLabels(v.labels, key, "", ""), formatFloat(h.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", v.name, formatLabels(v.labels, key, "", ""), h.count)
+	}
+}
+
+func sortedKeys(values map[string]float64) []string {
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func formatLabels(names []string, key string, extraName, extraValue string) string {
+	pairs := make([]string, 0, len(names)+1)
+	if len(names) > 0 {
+		for i, value := range strings.Split(key, "\xff") {
+			if i < len(names) {
+				pairs = append(pairs, fmt.Sprintf("%s=\"%s\"", names[i], escapeLabel(value)))
+			}
+		}
+	}
+	if extraName != "" {
+		pairs = append(pairs, fmt.Sprintf("%s=\"%s\"", extraName, extraValue))
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func escapeLabel(value string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(value)
+}
+
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	sshd "github.com/gliderlabs/ssh"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+type (
+	RecordConfig struct {
+		Enable      bool   `json:"Enable"`
+		Dir         string `json:"Dir"`         // 录像保存目录
+		RecordInput bool   `json:"RecordInput"` // 是否同时记录用户输入，输入中可能包含密码
+	}
+
+	// Recorder 将 pty 会话录制为 asciicast v2 文件，nil 表示不录制
+	Recorder struct {
+		mu      sync.Mutex
+		f       *os.File
+		start   time.Time
+		input   bool
+		window  sshd.Window
+		pending map[string][]byte // 各事件流中未组成完整 UTF-8 字符的字节
+	}
+	castHeader struct {
+		Version   int               `json:"version"`
+		Width     int               `json:"width"`
+		Height    int               `json:"height"`
+		Timestamp int64             `json:"timestamp"`
+		Title     string            `json:"title,omitempty"`
+		Env       map[string]string `json:"env,omitempty"`
+	}
+	castWriter struct {
+		r    *Recorder
+		code string
+	}
+)
+
+func (c *RecordConfig) SetDefault() {
+	if c.Dir == "" {
+		c.Dir = "./records"
+	}
+}
+
+// NewRecorder 创建录像文件，文件名为 用户_时间_会话ID.cast，
+// 同一连接中同时打开多个 pty 会话时依次加上 _1、_2 等后缀
+func NewRecorder(cfg RecordConfig, sess sshd.Session, ptyReq sshd.Pty) (*Recorder, error) {
+	if !cfg.Enable {
+		return nil, nil
+	}
+	if err := os.MkdirAll(cfg.Dir, 0700); err != nil {
+		return nil, err
+	}
+	ctx := sess.Context()
+	now := time.Now()
+	base := fmt.Sprintf("%s_%s_%s", sanitizeFileName(ctx.User()), now.Format("20060102T150405"), shortSessionID(ctx))
+	f, err := createRecordFile(cfg.Dir, base)
+	if err != nil {
+		return nil, err
+	}
+	r := &Recorder{
+		f:       f,
+		start:   now,
+		input:   cfg.RecordInput,
+		window:  ptyReq.Window,
+		pending: make(map[string][]byte),
+	}
+	header := castHeader{
+		Version:   2,
+		Width:     ptyReq.Window.Width,
+		Height:    ptyReq.Window.Height,
+		Timestamp: now.Unix(),
+		Title:     fmt.Sprintf("%s@%s", ctx.User(), ctx.RemoteAddr().String()),
+		Env: map[string]string{
+			"TERM":  ptyReq.Term,
+			"SHELL": "bash",
+		},
+	}
+	data, _ := json.Marshal(header)
+	if _, err := f.Write(append(data, '\n')); err != nil {
+		_ = f.Close()
+		return nil, err
+	}
+	return r, nil
+}
+
+// createRecordFile 以 O_EXCL 创建录像文件，文件已存在时换下一个后缀
+func createRecordFile(dir, base string) (*os.File, error) {
+	name := base + ".cast"
+	for i := 1; ; i++ {
+		f, err := os.OpenFile(filepath.Join(dir, name), os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+		if err == nil || !os.IsExist(err) || i > 1000 {
+			return f, err
+		}
+		name = fmt.Sprintf("%s_%d.cast", base, i)
+	}
+}
+
+// Output 返回记录终端输出的 Writer
+func (r *Recorder) Output() io.Writer {
+	return &castWriter{r: r, code: "o"}
+}
+
+// Input 返回记录用户输入的 Writer，未开启输入录制时丢弃
+func (r *Recorder) Input() io.Writer {
+	return &castWriter{r: r, code: "i"}
+}
+
+func (r *Recorder) Resize(win sshd.Window) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if win == r.window {
+		return
+	}
+	r.window = win
+	r.event("r", fmt.Sprintf("%dx%d", win.Width, win.Height))
+}
+
+func (r *Recorder) Close() error {
+	if r == nil {
+		return nil
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.f == nil {
+		return nil
+	}
+	err := r.f.Close()
+	r.f = nil
+	return err
+}
+
+func (w *castWriter) Write(p []byte) (int, error) {
+	r := w.r
+	if r == nil || (w.code == "i" && !r.input) {
+		return len(p), nil
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	data := append(r.pending[w.code], p...)
+	// 末尾不完整的 UTF-8 字符留到下一次写入
+	cut := len(data)
+	for i := len(data) - 1; i >= 0 && i >= len(data)-utf8.UTFMax; i-- {
+		if utf8.RuneStart(data[i]) {
+			if !utf8.FullRune(data[i:]) {
+				cut = i
+			}
+			break
+		}
+	}
+	r.pending[w.code] = append([]byte(nil), data[cut:]...)
+	if cut > 0 {
+		r.event(w.code, string(data[:cut]))
+	}
+	return len(p), nil
+}
+
+func (r *Recorder) event(code string, data string) {
+	if r.f == nil {
+		return
+	}
+	line, err := json.Marshal([]interface{}{time.Since(r.start).Seconds(), code, data})
+	if err != nil {
+		return
+	}
+	_, _ = r.f.Write(append(line, '\n'))
+}
+
+func sanitizeFileName(name string) string {
+	return strings.Map(func(c rune) rune {
+		if c == '/' || c == '\\' || c == ':' || c < 0x20 {
+			return '_'
+		}
+		return c
+	}, name)
+}
@@ -0,0 +1,57 @@
+package main
+
+type (
+	// ResourceLimits 会话中命令的资源限制，仅在 Linux 上生效，0 或空表示不限制
+	ResourceLimits struct {
+		CPUTime      uint64 `json:"CPUTime"`      // RLIMIT_CPU，秒
+		AddressSpace uint64 `json:"AddressSpace"` // RLIMIT_AS，MB
+		OpenFiles    uint64 `json:"OpenFiles"`    // RLIMIT_NOFILE
+		Processes    uint64 `json:"Processes"`    // RLIMIT_NPROC，按运行服务的系统用户计算，对 root 无效
+		MemoryMax    string `json:"MemoryMax"`    // 写入 cgroup 的 memory.max，如 512M，需要设置 CgroupRoot
+		CPUMax       string `json:"CPUMax"`       // 写入 cgroup 的 cpu.max，如 "50000 100000" 表示半个 CPU，需要设置 CgroupRoot
+	}
+
+	// procLimits 一个会话中所有命令共用的资源限制，nil 表示不限制
+	procLimits struct {
+		Path   string         `json:"Path"` // 真正要执行的命令
+		Limits ResourceLimits `json:"Limits"`
+		Cgroup string         `json:"Cgroup"` // 会话的 cgroup 目录，为空时不加入
+	}
+)
+
+// IsZero 没有设置任何限制
+func (r ResourceLimits) IsZero() bool {
+	return r == ResourceLimits{}
+}
+
+// merge 账号中设置的项覆盖全局配置
+func (r ResourceLimits) merge(o ResourceLimits) ResourceLimits {
+	if o.CPUTime != 0 {
+		r.CPUTime = o.CPUTime
+	}
+	if o.AddressSpace != 0 {
+		r.AddressSpace = o.AddressSpace
+	}
+	if o.OpenFiles != 0 {
+		r.OpenFiles = o.OpenFiles
+	}
+	if o.Processes != 0 {
+		r.Processes = o.Processes
+	}
+	if o.MemoryMax != "" {
+		r.MemoryMax = o.MemoryMax
+	}
+	if o.CPUMax != "" {
+		r.CPUMax = o.CPUMax
+	}
+	return r
+}
+
+// ResourceLimits 返回用户的资源限制，账号中的设置优先
+func (c *Config) ResourceLimits(user string) ResourceLimits {
+	limits := c.Resources
+	if account := c.LookupAccount(user); account != nil {
+		limits = limits.merge(account.Resources)
+	}
+	return limits
+}
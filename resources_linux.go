@@ -0,0 +1,177 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	sshd "github.com/gliderlabs/ssh"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"syscall"
+)
+
+const (
+	// procLimitsEnv 带有该环境变量启动时，自身作为启动器设置资源限制后 exec 真正的命令
+	procLimitsEnv = EnvPrefix + "PROC_LIMITS"
+	// rlimitNproc syscall 包中没有 RLIMIT_NPROC，x86 和 arm 上均为 6
+	rlimitNproc = 6
+)
+
+// sessionLimits 返回会话中命令的资源限制，设置了 MemoryMax 或 CPUMax 时为会话创建 cgroup，
+// 返回的函数在会话结束时删除 cgroup
+func (h *SSH) sessionLimits(sess sshd.Session) (*procLimits, func()) {
+	cfg := h.srv.Config()
+	limits := cfg.ResourceLimits(sess.User())
+	if limits.IsZero() {
+		return nil, func() {}
+	}
+	log := sessionLogger(h.log, sess, "limits")
+	p := &procLimits{Limits: limits}
+	if limits.MemoryMax == "" && limits.CPUMax == "" {
+		return p, func() {}
+	}
+	if cfg.CgroupRoot == "" {
+		log.Warn("MemoryMax and CPUMax require CgroupRoot, ignored", "memory_max", limits.MemoryMax, "cpu_max", limits.CPUMax)
+		return p, func() {}
+	}
+	// 同一连接中的每个会话使用各自的 cgroup
+	base := filepath.Join(cfg.CgroupRoot, fmt.Sprintf("%s-%s", sanitizeFileName(sess.User()), shortSessionID(sess.Context())))
+	dir, err := createCgroup(base, limits)
+	if err != nil {
+		// cgroup 不可用时仍然设置 rlimit
+		log.Error("create cgroup failed", "cgroup", base, "err", err)
+		if dir != "" {
+			_ = os.Remove(dir)
+		}
+		return p, func() {}
+	}
+	p.Cgroup = dir
+	log.Debug("session cgroup", "cgroup", dir)
+	return p, func() {
+		// 会话结束后仍有后台进程时无法删除
+		if err := os.Remove(dir); err != nil {
+			log.Warn("remove cgroup failed", "cgroup", dir, "err", err)
+		}
+	}
+}
+
+// createCgroup 创建 cgroup v2 目录并写入限制，上级目录需要已在 cgroup.subtree_control 中开启 memory 和 cpu。
+// base 已存在时依次加上 -1、-2 等后缀，返回实际创建的目录，创建失败时为空
+func createCgroup(base string, limits ResourceLimits) (string, error) {
+	parent := filepath.Dir(base)
+	// 尽量为子目录开启需要的控制器，已开启或没有权限时忽略
+	for _, controller := range []string{"+memory", "+cpu"} {
+		_ = os.WriteFile(filepath.Join(parent, "cgroup.subtree_control"), []byte(controller), 0644)
+	}
+	dir := base
+	for i := 1; ; i++ {
+		err := os.Mkdir(dir, 0755)
+		if err == nil {
+			break
+		}
+		if !os.IsExist(err) || i > 1000 {
+			return "", err
+		}
+		dir = fmt.Sprintf("%s-%d", base, i)
+	}
+	if limits.MemoryMax != "" {
+		if err := os.WriteFile(filepath.Join(dir, "memory.max"), []byte(limits.MemoryMax), 0644); err != nil {
+			return dir, err
+		}
+	}
+	if limits.CPUMax != "" {
+		if err := os.WriteFile(filepath.Join(dir, "cpu.max"), []byte(limits.CPUMax), 0644); err != nil {
+			return dir, err
+		}
+	}
+	return dir, nil
+}
+
+// encodeProcLimits 生成传给启动器的环境变量
+func encodeProcLimits(p procLimits) (string, error) {
+	data, err := json.Marshal(p)
+	if err != nil {
+		return "", err
+	}
+	return procLimitsEnv + "=" + string(data), nil
+}
+
+// decodeProcLimits 读取并清除启动器的环境变量，不是启动器时返回 false
+func decodeProcLimits() (procLimits, bool, error) {
+	var p procLimits
+	val, ok := os.LookupEnv(procLimitsEnv)
+	if !ok {
+		return p, false, nil
+	}
+	_ = os.Unsetenv(procLimitsEnv)
+	return p, true, json.Unmarshal([]byte(val), &p)
+}
+
+// Apply 改为通过自身启动命令，在 exec 之前设置 rlimit 并加入 cgroup，
+// 子进程在执行用户命令前就已受到限制，不存在先启动后限制的时间窗口
+func (p *procLimits) Apply(cmd *exec.Cmd) error {
+	if p == nil || cmd.Err != nil {
+		return nil
+	}
+	self, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	spec := *p
+	spec.Path = cmd.Path
+	env, err := encodeProcLimits(spec)
+	if err != nil {
+		return err
+	}
+	if cmd.Env == nil {
+		cmd.Env = os.Environ()
+	}
+	cmd.Env = append(cmd.Env, env)
+	cmd.Path = self
+	return nil
+}
+
+// RunProcLimits 作为启动器运行时设置资源限制并 exec 真正的命令，不会返回；不是启动器时直接返回
+func RunProcLimits() {
+	p, ok, err := decodeProcLimits()
+	if !ok {
+		return
+	}
+	if err == nil {
+		err = p.enter()
+	}
+	if err == nil {
+		err = syscall.Exec(p.Path, os.Args, os.Environ())
+	}
+	_, _ = fmt.Fprintf(os.Stderr, "%s: %s\n", filepath.Base(p.Path), err.Error())
+	os.Exit(126)
+}
+
+// enter 在当前进程上设置 rlimit 并加入 cgroup，exec 后由命令继承
+func (p *procLimits) enter() error {
+	if p.Cgroup != "" {
+		err := os.WriteFile(filepath.Join(p.Cgroup, "cgroup.procs"), []byte(strconv.Itoa(os.Getpid())), 0644)
+		if err != nil {
+			return err
+		}
+	}
+	rlimits := []struct {
+		resource int
+		value    uint64
+	}{
+		{syscall.RLIMIT_CPU, p.Limits.CPUTime},
+		{syscall.RLIMIT_AS, p.Limits.AddressSpace << 20},
+		{syscall.RLIMIT_NOFILE, p.Limits.OpenFiles},
+		{rlimitNproc, p.Limits.Processes},
+	}
+	for _, r := range rlimits {
+		if r.value == 0 {
+			continue
+		}
+		if err := syscall.Setrlimit(r.resource, &syscall.Rlimit{Cur: r.value, Max: r.value}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
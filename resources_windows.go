@@ -0,0 +1,19 @@
+package main
+
+import (
+	sshd "github.com/gliderlabs/ssh"
+	"os/exec"
+)
+
+// sessionLimits Windows 上不支持资源限制
+func (h *SSH) sessionLimits(sess sshd.Session) (*procLimits, func()) {
+	return nil, func() {}
+}
+
+func (p *procLimits) Apply(cmd *exec.Cmd) error {
+	return nil
+}
+
+func RunProcLimits() {
+
+}
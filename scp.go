@@ -8,7 +8,6 @@ import (
 	sshd "github.com/gliderlabs/ssh"
 	"io"
 	"io/fs"
-	"log"
 	"os"
 	"path"
 	"strconv"
@@ -28,7 +27,10 @@ const (
 
 type (
 	SCP struct {
-		rw io.ReadWriter
+		rw    io.ReadWriter
+		sess  sshd.Session
+		log   Logger
+		audit *Auditor
 	}
 	T struct {
 		AccessTimestamp int64
@@ -56,14 +58,20 @@ type (
 	}
 )
 
-func NewSCPServer() *SCP {
-	s := &SCP{}
+func NewSCPServer(log Logger, audit *Auditor) *SCP {
+	s := &SCP{
+		log:   log,
+		audit: audit,
+	}
 	return s
 }
 
 func (h *SCP) Handle(sess sshd.Session) {
 	defer sess.Close()
-	fmt.Println(sess.Command())
+	h.sess = sess
+	h.log = sessionLogger(h.log, sess, "scp")
+	h.log.Info("scp", "command", sess.RawCommand())
+	defer metrics.SessionStart(SessionTypeSCP)()
 	//cmd := exec.Command("scp", sess.Command()[1:]...)
 	//rw := RW{
 	//	r: sess,
@@ -115,7 +123,7 @@ func (h *SCP) parseCmd(sess sshd.Session) (info SCPCommand) {
 }
 
 func (h *SCP) upload(command SCPCommand) {
-	fmt.Println("upload ")
+	h.log.Debug("upload", "dest", command.Destination, "recursive", command.Recursive)
 	if command.Recursive { // 传的是文件夹
 		_ = os.Mkdir(path.Clean(command.Destination), 755)
 	}
@@ -161,6 +169,7 @@ func (h *SCP) dealUpload(r *bufio.Reader, t *T, recursive bool, prefixDir string
 			}
 		}
 		err = h.writeFile(r, t, cInstruction, prefixDir)
+		h.recordFile(AuditEventSCPUpload, path.Join(prefixDir, cInstruction.Name), int64(cInstruction.Size), err)
 		if err != nil {
 			h.reply(SCPCodeFault, err.Error())
 			return err
@@ -347,7 +356,7 @@ func (h *SCP) createDirectory(t *T, d *D, dir string) error {
 }
 
 func (h *SCP) download(command SCPCommand) {
-	fmt.Println("download")
+	h.log.Debug("download", "path", command.Destination, "recursive", command.Recursive)
 	fpath := command.Destination
 	// 检查目标文件
 	info, err := os.Stat(fpath)
@@ -361,7 +370,7 @@ func (h *SCP) download(command SCPCommand) {
 	// 读取是否OK
 	err = h.readReply()
 	if err != nil {
-		log.Println("something wrong:" + err.Error())
+		h.log.Warn("read scp reply failed", "err", err)
 		return
 	}
 	//h.replyOK() // 回复ok
@@ -374,7 +383,7 @@ func (h *SCP) dealDownload(w io.Writer, keepMetaInfo bool, prefixFile string) {
 		// 处理文件夹
 		err := h.dealDirectory(w, keepMetaInfo, path.Dir(path.Clean(prefixFile)), info)
 		if err != nil {
-			log.Println(err.Error())
+			h.log.Warn("download directory failed", "path", prefixFile, "err", err)
 			return
 		}
 		return
@@ -382,7 +391,7 @@ func (h *SCP) dealDownload(w io.Writer, keepMetaInfo bool, prefixFile string) {
 	// 处理文件
 	err := h.dealFile(w, keepMetaInfo, path.Dir(path.Clean(prefixFile)), info)
 	if err != nil {
-		log.Println(err.Error())
+		h.log.Warn("download file failed", "path", prefixFile, "err", err)
 		return
 	}
 }
@@ -416,7 +425,8 @@ func (h *SCP) dealFile(w io.Writer, keepMetaInfo bool, prefixDir string, info os
 		return err
 	}
 	defer f.Close()
-	_, _ = io.Copy(w, f)
+	n, copyErr := io.Copy(w, f)
+	h.recordFile(AuditEventSCPDownload, path.Join(prefixDir, info.Name()), n, copyErr)
 	_, _ = w.Write([]byte{0}) // 写入结束标志
 	err = h.readReply()
 	if err != nil { // 读取结果
@@ -482,6 +492,24 @@ func (h *SCP) dealDirectory(w io.Writer, keepMetaInfo bool, prefixDir string, in
 	return nil
 }
 
+// recordFile 记录文件传输的审计事件和流量指标
+func (h *SCP) recordFile(event string, fpath string, size int64, err error) {
+	ev := AuditEvent{
+		Event: event,
+		Path:  fpath,
+		Size:  size,
+	}
+	ev.Result, ev.Error = auditResult(err)
+	h.audit.Session(h.sess, ev)
+	direction := TransferDownload
+	if event == AuditEventSCPUpload {
+		direction = TransferUpload
+	}
+	if err == nil {
+		metrics.TransferBytes.Add(float64(size), SessionTypeSCP, direction)
+	}
+}
+
 func (h *SCP) replyOK() {
 	h.reply(SCPCodeOK, "")
 }
@@ -521,7 +549,7 @@ func (h *SCP) readReply() (err error) {
 		return errors.New(msg)
 	}
 	if code == SCPCodeWarning {
-		log.Println("warning: " + msg)
+		h.log.Warn("scp client warning", "msg", msg)
 	}
 	return nil
 }
@@ -0,0 +1,550 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	sshd "github.com/gliderlabs/ssh"
+	"golang.org/x/crypto/ssh"
+	"net"
+	"os"
+	"os/signal"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+type (
+	// ConfigLoader 读取最新的配置，SIGHUP 时会重新调用
+	ConfigLoader func() (Config, error)
+
+	Server struct {
+		srv     *sshd.Server
+		loader  ConfigLoader
+		cfg     atomic.Value // Config
+		chain   atomic.Value // AuthChain，随配置一起创建，重新加载时替换
+		keys    *hostKeySet  // 主机密钥，重新加载时替换
+		log     Logger
+		audit   *Auditor
+		guard   *Guard
+		limiter *Limiter
+		history *LoginHistory
+		// watchInterval watchConn 检查超时的间隔
+		watchInterval time.Duration
+	}
+)
+
+func NewServer(cfg Config, loader ConfigLoader, log Logger) (*Server, error) {
+	s := &Server{
+		loader:        loader,
+		log:           log,
+		watchInterval: time.Second,
+	}
+	signers, err := cfg.HostSigners()
+	if err != nil {
+		return nil, err
+	}
+	chain, err := NewAuthChain(&cfg)
+	if err != nil {
+		return nil, err
+	}
+	s.audit, err = NewAuditor(cfg.Audit)
+	if err != nil {
+		return nil, err
+	}
+	s.chain.Store(chain)
+	s.guard = NewGuard(log, s.audit)
+	s.limiter = NewLimiter()
+	s.history = &LoginHistory{}
+	s.keys = newHostKeySet(signers)
+	s.cfg.Store(cfg)
+	s.srv = &sshd.Server{
+		Addr:                          "",
+		Handler:                       nil,
+		HostSigners:                   s.keys.Slots(),
+		Version:                       "toolkits",
+		KeyboardInteractiveHandler:    nil,
+		PasswordHandler:               nil, // 认证回调在 serverConfigCallback 中设置，以便支持多步认证
+		PublicKeyHandler:              nil,
+		ConnCallback:                  s.connCallback,
+		PtyCallback:                   s.ptyCallback,
+		LocalPortForwardingCallback:   s.portForwardingCallback,
+		ReversePortForwardingCallback: nil, // 不支持 ssh -R，没有注册 tcpip-forward 请求
+		ServerConfigCallback:          s.serverConfigCallback,
+		SessionRequestCallback:        nil,
+		ConnectionFailedCallback:      nil,
+		IdleTimeout:                   0, // 超时在 watchConn 中按账号处理，keepalive 的收发不算作活动
+		MaxTimeout:                    0,
+		ChannelHandlers:               nil, // 在下面设置，session 需要处理 x11-req，direct-tcpip 需要统计会话
+		RequestHandlers:               nil,
+		SubsystemHandlers:             nil,
+	}
+	s.srv.Handler = NewSSHHandler(s).Handle
+	s.srv.ChannelHandlers = map[string]sshd.ChannelHandler{
+		"session":              s.sessionChannelHandler,
+		directTCPIPChannelType: s.directTCPIPHandler,
+	}
+	initSubsystemHandler(s.srv, log, s.audit)
+	return s, nil
+}
+
+// Config 返回当前生效的配置
+func (s *Server) Config() Config {
+	return s.cfg.Load().(Config)
+}
+
+// Reload 重新加载配置，只对新建立的连接生效
+func (s *Server) Reload() error {
+	if s.loader == nil {
+		return errors.New("no config loader")
+	}
+	cfg, err := s.loader()
+	if err != nil {
+		return err
+	}
+	if err := cfg.Validate(); err != nil {
+		return err
+	}
+	signers, err := cfg.HostSigners()
+	if err != nil {
+		return err
+	}
+	chain, err := NewAuthChain(&cfg)
+	if err != nil {
+		return err
+	}
+	s.keys.Replace(s.srv, signers)
+	if l, ok := s.log.(interface{ SetLevel(string) }); ok {
+		l.SetLevel(cfg.Log.Level)
+	}
+	if err := s.audit.Open(cfg.Audit); err != nil {
+		s.log.Error("open audit file failed", "file", cfg.Audit.File, "err", err)
+	}
+	s.cfg.Store(cfg)
+	// 旧的后端可能仍在处理认证，只关闭空闲连接
+	s.chain.Swap(chain).(AuthChain).Close()
+	return nil
+}
+
+// Serve 在所有监听上处理连接，直到收到 SIGTERM/SIGINT 并完成排空
+func (s *Server) Serve(listeners []net.Listener) error {
+	errCh := make(chan error, len(listeners))
+	for _, l := range listeners {
+		go func(l net.Listener) {
+			err := s.srv.Serve(l)
+			if err != nil && !errors.Is(err, sshd.ErrServerClosed) {
+				s.log.Error("serve failed", "addr", l.Addr().String(), "err", err)
+			}
+			errCh <- err
+		}(l)
+	}
+	running := len(listeners)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if addr := s.Config().Metrics.Listen; addr != "" {
+		if err := ServeMetrics(ctx, addr, s.log); err != nil {
+			s.log.Error("start metrics failed", "err", err)
+		}
+	}
+	go s.sweepGuard(ctx)
+	s.notify("READY=1")
+
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGTERM, syscall.SIGHUP, os.Interrupt)
+	defer signal.Stop(sigCh)
+	for {
+		select {
+		case err := <-errCh:
+			running--
+			if running == 0 {
+				return err
+			}
+		case sig := <-sigCh:
+			if sig == syscall.SIGHUP {
+				s.notify("RELOADING=1")
+				err := s.Reload()
+				s.notify("READY=1")
+				if err != nil {
+					s.log.Error("reload config failed", "err", err)
+				} else {
+					s.log.Info("config reloaded")
+				}
+				continue
+			}
+			s.log.Info("shutting down", "signal", sig.String())
+			s.notify("STOPPING=1")
+			s.Shutdown(time.Duration(s.Config().ShutdownTimeout) * time.Second)
+			for ; running > 0; running-- {
+				<-errCh
+			}
+			return nil
+		}
+	}
+}
+
+// Shutdown 停止接收新连接，并在 timeout 内等待已有会话结束，超时后强制关闭
+func (s *Server) Shutdown(timeout time.Duration) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	err := s.srv.Shutdown(ctx)
+	if errors.Is(err, context.DeadlineExceeded) {
+		s.log.Warn("sessions not drained, closing", "timeout", timeout)
+		_ = s.srv.Close()
+	}
+	_ = s.audit.Close()
+}
+
+// sweepGuard 定期解除到期的封禁
+func (s *Server) sweepGuard(ctx context.Context) {
+	ticker := time.NewTicker(10 * time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			s.guard.Sweep(s.Config().BruteForce)
+		}
+	}
+}
+
+func (s *Server) connCallback(ctx sshd.Context, conn net.Conn) net.Conn {
+	// SetValue 会替换 ctx 内部的 context，之后其他 goroutine 不能再调用 ctx 的方法
+	done := ctx.Done()
+	if lc, ok := conn.(*listenerConn); ok {
+		ctx.SetValue(ctxKeyListenAddr, lc.addr)
+	}
+	ctx.SetValue(ctxKeyAcceptTime, time.Now())
+	metrics.ConnectionsTotal.Add(1)
+	cfg := s.Config().BruteForce
+	ip := remoteIP(conn.RemoteAddr())
+	if !cfg.Disable && s.guard.IPBanned(ip) {
+		s.rejectConn(conn, "banned", "too many authentication failures, try again later")
+		return nil
+	}
+	if allowed, err := s.Config().Access.Allowed(remoteAddr(conn.RemoteAddr())); !allowed {
+		if err != nil {
+			s.log.Error("check access rules failed", "err", err)
+		}
+		s.rejectConn(conn, "acl", "connection not allowed from this address")
+		return nil
+	}
+	limits := s.Config().Limits
+	if limits.startups.Drop(s.guard.Pending()) {
+		s.rejectConn(conn, "startups", "too many connections in progress, try again later")
+		return nil
+	}
+	releaseConn := s.limiter.AcquireConn(limits.MaxConnections)
+	if releaseConn == nil {
+		s.rejectConn(conn, "max-connections", "too many connections, try again later")
+		return nil
+	}
+	release := s.guard.AcquirePending(cfg)
+	if release == nil {
+		releaseConn()
+		s.rejectConn(conn, "unauthenticated", "too many unauthenticated connections, try again later")
+		return nil
+	}
+	ctx.SetValue(ctxKeyReleasePending, release)
+	ctx.SetValue(ctxKeySessions, new(int32))
+	act := newConnActivity(time.Now(), done)
+	ctx.SetValue(ctxKeyActivity, act)
+	metrics.ConnectionsActive.Add(1)
+	tracked := &trackedConn{Conn: conn, onClose: func() {
+		act.Close()
+		release()
+		releaseConn()
+		metrics.ConnectionsActive.Add(-1)
+	}}
+	go s.watchConn(tracked, act)
+	return tracked
+}
+
+// rejectConn 在版本交换之前拒绝连接，RFC 4253 允许服务端在版本号之前发送其他文本行
+func (s *Server) rejectConn(conn net.Conn, reason, msg string) {
+	metrics.ConnectionsRejected.Add(1, reason)
+	s.log.Warn("connection rejected", "remote", conn.RemoteAddr().String(), "reason", reason)
+	_ = conn.SetWriteDeadline(time.Now().Add(time.Second))
+	_, _ = conn.Write([]byte(msg + "\r\n"))
+}
+
+// authBanned 判断连接的 IP 或登录用户是否处于封禁中
+func (s *Server) authBanned(ctx sshd.Context) bool {
+	if s.Config().BruteForce.Disable {
+		return false
+	}
+	return s.guard.IPBanned(remoteIP(ctx.RemoteAddr())) || s.guard.UserBanned(ctx.User())
+}
+
+// authAllowed 检查全局和账号的来源网段限制，配置变更后对已建立的连接同样生效
+func (s *Server) authAllowed(ctx sshd.Context) bool {
+	cfg := s.Config()
+	addr := remoteAddr(ctx.RemoteAddr())
+	rules := []IPRules{cfg.Access}
+	if account := cfg.LookupAccount(ctx.User()); account != nil {
+		rules = append(rules, account.Access)
+	}
+	for _, rule := range rules {
+		allowed, err := rule.Allowed(addr)
+		if err != nil {
+			s.log.Error("check access rules failed", "err", err)
+		}
+		if !allowed {
+			s.log.Warn("auth denied by access rules", "user", ctx.User(), "remote", ctx.RemoteAddr().String())
+			return false
+		}
+	}
+	return true
+}
+
+func (s *Server) passwordHandler(ctx sshd.Context, password string) bool {
+	if !connListenAddr(ctx).AllowAuth(AuthMethodPassword) || s.authBanned(ctx) || !s.authAllowed(ctx) {
+		return false
+	}
+	backend, result, err := s.authChain().CheckPassword(authRequest(ctx), password)
+	if err != nil {
+		s.authRejected(ctx, AuthMethodPassword, backend, err)
+		return false
+	}
+	ctx.SetValue(ctxKeyAuthResult, result)
+	return true
+}
+
+// authChain 返回当前配置的认证后端
+func (s *Server) authChain() AuthChain {
+	return s.chain.Load().(AuthChain)
+}
+
+func authRequest(ctx sshd.Context) AuthRequest {
+	return AuthRequest{User: ctx.User(), RemoteAddr: ctx.RemoteAddr().String()}
+}
+
+// authRejected 用户不存在或凭据错误时只记录 debug 日志，后端出错时记录 error
+func (s *Server) authRejected(ctx sshd.Context, method, backend string, err error) {
+	if errors.Is(err, ErrUnknownUser) || errors.Is(err, ErrWrongPassword) || errors.Is(err, ErrKeyNotAllowed) {
+		s.log.Debug("auth rejected", "user", ctx.User(), "method", method, "backend", backend, "err", err)
+		return
+	}
+	s.log.Error("auth backend failed", "user", ctx.User(), "method", method, "backend", backend, "err", err)
+}
+
+// publicKeyHandler 校验公钥或用户证书，证书登录时返回证书中的权限
+func (s *Server) publicKeyHandler(ctx sshd.Context, conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+	ctx.SetValue(ctxKeyOfferedKey, key)
+	if !connListenAddr(ctx).AllowAuth(AuthMethodPublicKey) || s.authBanned(ctx) || !s.authAllowed(ctx) {
+		return nil, errors.New("permission denied")
+	}
+	cfg := s.Config()
+	if cert, ok := key.(*ssh.Certificate); ok {
+		perms, err := cfg.CheckUserCert(conn, cert)
+		if err != nil {
+			s.log.Warn("user certificate rejected", "user", conn.User(), "remote", conn.RemoteAddr().String(),
+				"key_id", cert.KeyId, "serial", cert.Serial, "err", err)
+			return nil, err
+		}
+		s.log.Debug("user certificate accepted", "user", conn.User(), "key_id", cert.KeyId, "serial", cert.Serial)
+		return perms, nil
+	}
+	backend, result, err := s.authChain().CheckPublicKey(authRequest(ctx), key)
+	if err != nil {
+		s.authRejected(ctx, AuthMethodPublicKey, backend, err)
+		return nil, errors.New("permission denied")
+	}
+	ctx.SetValue(ctxKeyAuthResult, result)
+	return ctx.Permissions().Permissions, nil
+}
+
+func (s *Server) ptyCallback(ctx sshd.Context, pty sshd.Pty) bool {
+	return certPermits(ctx, certExtPermitPty)
+}
+
+func (s *Server) serverConfigCallback(ctx sshd.Context) *ssh.ServerConfig {
+	cfg := s.Config()
+	config := &ssh.ServerConfig{
+		// 未设置 sshd 的认证 handler 时 gliderlabs 会打开 NoClientAuth，这里拒绝 none 认证
+		NoClientAuthCallback: func(conn ssh.ConnMetadata) (*ssh.Permissions, error) {
+			return nil, errors.New("permission denied")
+		},
+		PasswordCallback: func(conn ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+			applyConnMetadata(ctx, conn)
+			if !s.passwordHandler(ctx, string(password)) {
+				return nil, errors.New("permission denied")
+			}
+			return s.firstFactorPassed(ctx, ctx.Permissions().Permissions)
+		},
+		PublicKeyCallback: func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			applyConnMetadata(ctx, conn)
+			perms, err := s.publicKeyHandler(ctx, conn, key)
+			if err != nil {
+				return nil, err
+			}
+			ctx.SetValue(sshd.ContextKeyPublicKey, key)
+			return s.firstFactorPassed(ctx, perms)
+		},
+		AuthLogCallback: func(conn ssh.ConnMetadata, method string, err error) {
+			s.authLog(ctx, conn, method, err)
+		},
+		BannerCallback: func(conn ssh.ConnMetadata) string {
+			banner, err := cfg.Login.BannerText()
+			if err != nil {
+				s.log.Warn("read banner failed", "err", err)
+			}
+			return banner
+		},
+	}
+	if cfg.ServerConfig != nil {
+		config.Config = ssh.Config{
+			KeyExchanges: cfg.ServerConfig.KeyExchanges,
+			Ciphers:      cfg.ServerConfig.Ciphers,
+			MACs:         cfg.ServerConfig.MACs,
+		}
+		config.MaxAuthTries = cfg.ServerConfig.MaxAuthTries
+	}
+	return config
+}
+
+// firstFactorPassed 密码或公钥认证通过后，账号配置了 TOTP 时要求继续通过 keyboard-interactive 输入验证码。
+// 部分成功时同样返回 perms，x/crypto 据此校验证书的 source-address
+func (s *Server) firstFactorPassed(ctx sshd.Context, perms *ssh.Permissions) (*ssh.Permissions, error) {
+	cfg := s.Config()
+	if account := cfg.LookupAccount(ctx.User()); account != nil && account.TOTPSecret != "" {
+		return perms, &ssh.PartialSuccessError{
+			Next: ssh.ServerAuthCallbacks{
+				KeyboardInteractiveCallback: func(conn ssh.ConnMetadata, challenge ssh.KeyboardInteractiveChallenge) (*ssh.Permissions, error) {
+					return s.totpCallback(ctx, challenge, perms)
+				},
+			},
+		}
+	}
+	return perms, nil
+}
+
+// totpCallback 校验验证码，通过后返回第一步认证得到的权限
+func (s *Server) totpCallback(ctx sshd.Context, challenge ssh.KeyboardInteractiveChallenge, perms *ssh.Permissions) (*ssh.Permissions, error) {
+	cfg := s.Config()
+	account := cfg.LookupAccount(ctx.User())
+	if account == nil || account.TOTPSecret == "" {
+		return nil, errors.New("permission denied")
+	}
+	answers, err := challenge("", "", []string{"Verification code: "}, []bool{false})
+	if err != nil {
+		return nil, err
+	}
+	if len(answers) != 1 {
+		return nil, errors.New("permission denied")
+	}
+	ok, err := VerifyTOTP(account.TOTPSecret, account.Username, answers[0], time.Now())
+	if err != nil {
+		s.log.Error("verify totp failed", "user", account.Username, "err", err)
+	}
+	if !ok {
+		return nil, errors.New("invalid verification code")
+	}
+	return perms, nil
+}
+
+// applyConnMetadata 与 gliderlabs 内部的实现一致，在认证回调中填充会话信息
+func applyConnMetadata(ctx sshd.Context, conn ssh.ConnMetadata) {
+	if ctx.Value(sshd.ContextKeySessionID) != nil {
+		return
+	}
+	ctx.SetValue(sshd.ContextKeySessionID, hex.EncodeToString(conn.SessionID()))
+	ctx.SetValue(sshd.ContextKeyClientVersion, string(conn.ClientVersion()))
+	ctx.SetValue(sshd.ContextKeyServerVersion, string(conn.ServerVersion()))
+	ctx.SetValue(sshd.ContextKeyUser, conn.User())
+	ctx.SetValue(sshd.ContextKeyLocalAddr, conn.LocalAddr())
+	ctx.SetValue(sshd.ContextKeyRemoteAddr, conn.RemoteAddr())
+}
+
+// authLog 记录每次认证的结果
+func (s *Server) authLog(ctx sshd.Context, conn ssh.ConnMetadata, method string, err error) {
+	if method == "none" {
+		return
+	}
+	ev := AuditEvent{
+		Event:   AuditEventAuth,
+		Session: shortSessionID(ctx),
+		User:    conn.User(),
+		Remote:  conn.RemoteAddr().String(),
+		Method:  method,
+	}
+	if key, ok := ctx.Value(ctxKeyOfferedKey).(ssh.PublicKey); ok && method == AuthMethodPublicKey {
+		ev.Fingerprint = ssh.FingerprintSHA256(key)
+	}
+	ev.Result, ev.Error = auditResult(err)
+	s.audit.Log(ev)
+	metrics.AuthAttempts.Add(1, method, ev.Result)
+	if acceptAt, ok := ctx.Value(ctxKeyAcceptTime).(time.Time); ok && err == nil {
+		metrics.HandshakeSeconds.Observe(time.Since(acceptAt).Seconds())
+	}
+	s.log.Info("auth", "session", ev.Session, "user", ev.User, "remote", ev.Remote, "method", method,
+		"fingerprint", ev.Fingerprint, "result", ev.Result)
+	s.guardAuth(ctx, conn, method, err)
+	if err == nil {
+		if act, ok := ctx.Value(ctxKeyActivity).(*connActivity); ok {
+			act.SetUser(conn.User(), shortSessionID(ctx))
+		}
+		s.limitUser(ctx, conn.User())
+	}
+}
+
+// guardAuth 认证成功时清零计数并释放未认证名额，密码类认证失败时计数并退避。
+// 客户端会依次尝试多个公钥，公钥失败不计数
+func (s *Server) guardAuth(ctx sshd.Context, conn ssh.ConnMetadata, method string, err error) {
+	ip := remoteIP(conn.RemoteAddr())
+	if _, ok := err.(*ssh.PartialSuccessError); ok {
+		return
+	}
+	if err == nil {
+		s.guard.Success(ip, conn.User())
+		if release, ok := ctx.Value(ctxKeyReleasePending).(func()); ok {
+			release()
+		}
+		return
+	}
+	if method != AuthMethodPassword && method != AuthMethodKeyboardInteractive {
+		return
+	}
+	if delay := s.guard.Failure(s.Config().BruteForce, ip, conn.User()); delay > 0 {
+		time.Sleep(delay)
+	}
+}
+
+func initSubsystemHandler(srv *sshd.Server, log Logger, audit *Auditor) {
+	srv.SubsystemHandlers = map[string]sshd.SubsystemHandler{
+		"sftp": func(sess sshd.Session) {
+			NewSFTPServer(log, audit).Handle(newActiveSession(sess))
+		},
+	}
+}
+
+var (
+	// ctxKeyOfferedKey 客户端最近一次提供的公钥，用于审计
+	ctxKeyOfferedKey = &struct{ name string }{"offered-key"}
+	ctxKeyAcceptTime = &struct{ name string }{"accept-time"}
+	// ctxKeyAuthResult 认证后端返回的 *AuthResult
+	ctxKeyAuthResult = &struct{ name string }{"auth-result"}
+	// ctxKeyReleasePending 释放未认证连接名额的函数
+	ctxKeyReleasePending = &struct{ name string }{"release-pending"}
+)
+
+type (
+	// trackedConn 在连接关闭时回调一次
+	trackedConn struct {
+		net.Conn
+		once    sync.Once
+		onClose func()
+	}
+)
+
+func (c *trackedConn) Close() error {
+	c.once.Do(c.onClose)
+	return c.Conn.Close()
+}
+
+func (s *Server) notify(state string) {
+	if err := SdNotify(state); err != nil {
+		s.log.Warn("sd_notify failed", "state", state, "err", err)
+	}
+}
@@ -8,33 +8,51 @@ import (
 
 type (
 	SFTP struct {
-		sess sshd.Session
+		sess  sshd.Session
+		log   Logger
+		audit *Auditor
 	}
 )
 
-func NewSFTPServer() *SFTP {
-	s := &SFTP{}
+func NewSFTPServer(log Logger, audit *Auditor) *SFTP {
+	s := &SFTP{
+		log:   log,
+		audit: audit,
+	}
 	return s
 }
 
 func (h *SFTP) Handle(sess sshd.Session) {
+	h.log = sessionLogger(h.log, sess, "sftp")
 	defer func() {
 		if err := recover(); err != nil {
-			fmt.Println(err)
+			h.log.Error("sftp panic", "err", fmt.Sprint(err))
 		}
 	}()
 
 	h.sess = sess
 	defer h.Close()
-	defer fmt.Println("end sftp.........")
-	fmt.Println("start sftp...........")
-	srv, err := sftp.NewServer(h.sess, sftp.WithServerWorkingDirectory("/")) // 跟目录
+	defer h.log.Info("end sftp")
+	h.log.Info("start sftp")
+	defer metrics.SessionStart(SessionTypeSFTP)()
+	tap := newSFTPTap(h.sess, func(ev AuditEvent) {
+		h.audit.Session(sess, ev)
+		switch ev.Event {
+		case AuditEventSFTPWrite:
+			metrics.TransferBytes.Add(float64(ev.Size), SessionTypeSFTP, TransferUpload)
+		case AuditEventSFTPRead:
+			metrics.TransferBytes.Add(float64(ev.Size), SessionTypeSFTP, TransferDownload)
+		}
+	})
+	srv, err := sftp.NewServer(tap, sftp.WithServerWorkingDirectory("/")) // 跟目录
 	if err != nil {
+		h.log.Error("create sftp server failed", "err", err)
 		h.Reply(1, err.Error())
 		return
 	}
 	err = srv.Serve()
 	if err != nil {
+		h.log.Warn("sftp serve failed", "err", err)
 		h.Reply(1, err.Error())
 		return
 	}
@@ -0,0 +1,331 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+)
+
+// sftp 协议包类型，见 draft-ietf-secsh-filexfer-02
+const (
+	sftpPacketOpen     = 3
+	sftpPacketClose    = 4
+	sftpPacketRead     = 5
+	sftpPacketWrite    = 6
+	sftpPacketRemove   = 13
+	sftpPacketMkdir    = 14
+	sftpPacketRmdir    = 15
+	sftpPacketRename   = 18
+	sftpPacketStatus   = 101
+	sftpPacketHandle   = 102
+	sftpPacketData     = 103
+	sftpPacketExtended = 200
+
+	sftpMaxPacket = 1 << 20
+)
+
+// sftp 打开文件的标志位
+const (
+	sftpFlagRead   = 0x01
+	sftpFlagWrite  = 0x02
+	sftpFlagAppend = 0x04
+	sftpFlagCreate = 0x08
+	sftpFlagTrunc  = 0x10
+	sftpFlagExcl   = 0x20
+)
+
+// sftpStatusNames STATUS 的错误码，见 draft-ietf-secsh-filexfer-02
+var sftpStatusNames = []string{"ok", "eof", "no such file", "permission denied", "failure",
+	"bad message", "no connection", "connection lost", "operation unsupported"}
+
+type (
+	// sftpTap 旁路解析 sftp 数据包，不修改内容，用于审计文件操作
+	sftpTap struct {
+		rwc     io.ReadWriteCloser
+		onEvent func(AuditEvent)
+
+		mu       sync.Mutex
+		in       sftpPacketParser
+		out      sftpPacketParser
+		opening  map[uint32]*sftpOpenFile // 请求 id -> 打开中的文件
+		handles  map[string]*sftpOpenFile // handle -> 已打开的文件
+		readReqs map[uint32]string        // 读请求 id -> handle
+		pending  map[uint32]AuditEvent    // 请求 id -> 等待服务端结果的删除、重命名等操作
+	}
+	sftpOpenFile struct {
+		path    string
+		flags   uint32
+		read    int64
+		written int64
+	}
+	sftpPacketParser struct {
+		buf    []byte
+		broken bool
+	}
+)
+
+func newSFTPTap(rwc io.ReadWriteCloser, onEvent func(AuditEvent)) *sftpTap {
+	return &sftpTap{
+		rwc:      rwc,
+		onEvent:  onEvent,
+		opening:  make(map[uint32]*sftpOpenFile),
+		handles:  make(map[string]*sftpOpenFile),
+		readReqs: make(map[uint32]string),
+		pending:  make(map[uint32]AuditEvent),
+	}
+}
+
+func (t *sftpTap) Read(p []byte) (n int, err error) {
+	n, err = t.rwc.Read(p)
+	if n > 0 {
+		t.mu.Lock()
+		t.in.feed(p[:n], t.onRequest)
+		t.mu.Unlock()
+	}
+	return n, err
+}
+
+func (t *sftpTap) Write(p []byte) (n int, err error) {
+	n, err = t.rwc.Write(p)
+	if n > 0 {
+		t.mu.Lock()
+		t.out.feed(p[:n], t.onResponse)
+		t.mu.Unlock()
+	}
+	return n, err
+}
+
+// Close 关闭底层连接，并为客户端未关闭的文件和没有收到结果的操作补充记录
+func (t *sftpTap) Close() error {
+	t.mu.Lock()
+	for handle, f := range t.handles {
+		t.closeFile(f)
+		delete(t.handles, handle)
+	}
+	for id, event := range t.pending {
+		event.Result, event.Error = AuditResultFailure, "no response"
+		t.onEvent(event)
+		delete(t.pending, id)
+	}
+	t.mu.Unlock()
+	return t.rwc.Close()
+}
+
+func (t *sftpTap) onRequest(typ byte, data []byte) {
+	id, data, ok := sftpUint32(data)
+	if !ok {
+		return
+	}
+	switch typ {
+	case sftpPacketOpen:
+		path, data, ok := sftpString(data)
+		if !ok {
+			return
+		}
+		flags, _, _ := sftpUint32(data)
+		t.opening[id] = &sftpOpenFile{path: path, flags: flags}
+		t.onEvent(AuditEvent{Event: AuditEventSFTPOpen, Path: path, Flags: sftpFlagString(flags)})
+	case sftpPacketRead:
+		handle, _, ok := sftpString(data)
+		if ok {
+			t.readReqs[id] = handle
+		}
+	case sftpPacketWrite:
+		handle, data, ok := sftpString(data)
+		if !ok {
+			return
+		}
+		_, data, ok = sftpUint64(data)
+		if !ok {
+			return
+		}
+		if f := t.handles[handle]; f != nil {
+			if length, _, ok := sftpUint32(data); ok {
+				f.written += int64(length)
+			}
+		}
+	case sftpPacketClose:
+		handle, _, ok := sftpString(data)
+		if !ok {
+			return
+		}
+		if f := t.handles[handle]; f != nil {
+			t.closeFile(f)
+			delete(t.handles, handle)
+		}
+	case sftpPacketRemove:
+		if path, _, ok := sftpString(data); ok {
+			t.pending[id] = AuditEvent{Event: AuditEventSFTPRemove, Path: path}
+		}
+	case sftpPacketMkdir:
+		if path, _, ok := sftpString(data); ok {
+			t.pending[id] = AuditEvent{Event: AuditEventSFTPMkdir, Path: path}
+		}
+	case sftpPacketRmdir:
+		if path, _, ok := sftpString(data); ok {
+			t.pending[id] = AuditEvent{Event: AuditEventSFTPRmdir, Path: path}
+		}
+	case sftpPacketRename:
+		t.onRename(id, data)
+	case sftpPacketExtended:
+		name, data, ok := sftpString(data)
+		if ok && name == "posix-rename@openssh.com" {
+			t.onRename(id, data)
+		}
+	}
+}
+
+// onRename 记录等待结果的重命名，操作的结果在 onStatus 中记录
+func (t *sftpTap) onRename(id uint32, data []byte) {
+	oldPath, data, ok := sftpString(data)
+	if !ok {
+		return
+	}
+	newPath, _, ok := sftpString(data)
+	if !ok {
+		return
+	}
+	t.pending[id] = AuditEvent{Event: AuditEventSFTPRename, Path: oldPath, Target: newPath}
+}
+
+func (t *sftpTap) onResponse(typ byte, data []byte) {
+	id, data, ok := sftpUint32(data)
+	if !ok {
+		return
+	}
+	switch typ {
+	case sftpPacketHandle:
+		f := t.opening[id]
+		if f == nil {
+			return
+		}
+		delete(t.opening, id)
+		if handle, _, ok := sftpString(data); ok {
+			t.handles[handle] = f
+		}
+	case sftpPacketData:
+		handle, found := t.readReqs[id]
+		if !found {
+			return
+		}
+		delete(t.readReqs, id)
+		if f := t.handles[handle]; f != nil {
+			if length, _, ok := sftpUint32(data); ok {
+				f.read += int64(length)
+			}
+		}
+	case sftpPacketStatus:
+		t.onStatus(id, data)
+	default:
+		// 其他类型的响应，清理对应的请求
+		delete(t.opening, id)
+		delete(t.readReqs, id)
+	}
+}
+
+// onStatus 清理结束的请求，删除、重命名等操作在服务端返回结果后才记录
+func (t *sftpTap) onStatus(id uint32, data []byte) {
+	delete(t.opening, id)
+	delete(t.readReqs, id)
+	event, found := t.pending[id]
+	if !found {
+		return
+	}
+	delete(t.pending, id)
+	code, data, ok := sftpUint32(data)
+	switch {
+	case !ok:
+		event.Result, event.Error = AuditResultFailure, "bad status"
+	case code == 0:
+		event.Result = AuditResultSuccess
+	default:
+		event.Result = AuditResultFailure
+		if msg, _, ok := sftpString(data); ok && msg != "" {
+			event.Error = msg
+		} else if int(code) < len(sftpStatusNames) {
+			event.Error = sftpStatusNames[code]
+		} else {
+			event.Error = fmt.Sprintf("status %d", code)
+		}
+	}
+	t.onEvent(event)
+}
+
+func (t *sftpTap) closeFile(f *sftpOpenFile) {
+	if f.written > 0 || f.flags&sftpFlagWrite != 0 {
+		t.onEvent(AuditEvent{Event: AuditEventSFTPWrite, Path: f.path, Flags: sftpFlagString(f.flags), Size: f.written})
+	}
+	if f.read > 0 {
+		t.onEvent(AuditEvent{Event: AuditEventSFTPRead, Path: f.path, Size: f.read})
+	}
+}
+
+func (p *sftpPacketParser) feed(data []byte, onPacket func(typ byte, data []byte)) {
+	if p.broken {
+		return
+	}
+	p.buf = append(p.buf, data...)
+	for len(p.buf) >= 4 {
+		length := binary.BigEndian.Uint32(p.buf)
+		if length > sftpMaxPacket {
+			// 无法识别的数据，停止解析
+			p.broken = true
+			p.buf = nil
+			return
+		}
+		if uint32(len(p.buf)-4) < length {
+			return
+		}
+		if length > 0 {
+			onPacket(p.buf[4], p.buf[5:4+length])
+		}
+		p.buf = p.buf[4+length:]
+	}
+	if len(p.buf) == 0 {
+		p.buf = nil
+	}
+}
+
+func sftpUint32(data []byte) (uint32, []byte, bool) {
+	if len(data) < 4 {
+		return 0, data, false
+	}
+	return binary.BigEndian.Uint32(data), data[4:], true
+}
+
+func sftpUint64(data []byte) (uint64, []byte, bool) {
+	if len(data) < 8 {
+		return 0, data, false
+	}
+	return binary.BigEndian.Uint64(data), data[8:], true
+}
+
+func sftpString(data []byte) (string, []byte, bool) {
+	length, data, ok := sftpUint32(data)
+	if !ok || uint32(len(data)) < length {
+		return "", data, false
+	}
+	return string(data[:length]), data[length:], true
+}
+
+func sftpFlagString(flags uint32) string {
+	names := make([]string, 0)
+	for _, item := range []struct {
+		flag uint32
+		name string
+	}{
+		{sftpFlagRead, "read"},
+		{sftpFlagWrite, "write"},
+		{sftpFlagAppend, "append"},
+		{sftpFlagCreate, "create"},
+		{sftpFlagTrunc, "trunc"},
+		{sftpFlagExcl, "excl"},
+	} {
+		if flags&item.flag != 0 {
+			names = append(names, item.name)
+		}
+	}
+	return strings.Join(names, "|")
+}
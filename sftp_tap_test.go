@@ -0,0 +1,78 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"testing"
+)
+
+// sftpTestConn 从 in 读取客户端请求，服务端响应写入 out
+type sftpTestConn struct {
+	in  bytes.Buffer
+	out bytes.Buffer
+}
+
+func (c *sftpTestConn) Read(p []byte) (int, error)  { return c.in.Read(p) }
+func (c *sftpTestConn) Write(p []byte) (int, error) { return c.out.Write(p) }
+func (c *sftpTestConn) Close() error                { return nil }
+
+func sftpTestPacket(typ byte, id uint32, fields ...interface{}) []byte {
+	appendUint32 := func(b []byte, v uint32) []byte {
+		var buf [4]byte
+		binary.BigEndian.PutUint32(buf[:], v)
+		return append(b, buf[:]...)
+	}
+	body := appendUint32([]byte{typ}, id)
+	for _, field := range fields {
+		switch v := field.(type) {
+		case string:
+			body = append(appendUint32(body, uint32(len(v))), v...)
+		case uint32:
+			body = appendUint32(body, v)
+		}
+	}
+	return append(appendUint32(nil, uint32(len(body))), body...)
+}
+
+// TestSFTPTapPendingOps 删除、重命名等操作在服务端返回 STATUS 后才记录，并带上结果
+func TestSFTPTapPendingOps(t *testing.T) {
+	var events []AuditEvent
+	conn := &sftpTestConn{}
+	tap := newSFTPTap(conn, func(event AuditEvent) {
+		events = append(events, event)
+	})
+	conn.in.Write(sftpTestPacket(sftpPacketRemove, 1, "/tmp/a"))
+	conn.in.Write(sftpTestPacket(sftpPacketRename, 2, "/tmp/b", "/tmp/c"))
+	conn.in.Write(sftpTestPacket(sftpPacketMkdir, 3, "/tmp/d", uint32(0)))
+	conn.in.Write(sftpTestPacket(sftpPacketRmdir, 4, "/tmp/e"))
+	conn.in.Write(sftpTestPacket(sftpPacketExtended, 5, "posix-rename@openssh.com", "/tmp/f", "/tmp/g"))
+	if _, err := io.ReadAll(tap); err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 0 {
+		t.Fatalf("events before status = %+v", events)
+	}
+
+	_, _ = tap.Write(sftpTestPacket(sftpPacketStatus, 1, uint32(0), "", ""))
+	_, _ = tap.Write(sftpTestPacket(sftpPacketStatus, 2, uint32(3), "Permission denied", ""))
+	_, _ = tap.Write(sftpTestPacket(sftpPacketStatus, 3, uint32(4), "", ""))
+	_, _ = tap.Write(sftpTestPacket(sftpPacketStatus, 4, uint32(0), "", ""))
+	_ = tap.Close()
+
+	want := []AuditEvent{
+		{Event: AuditEventSFTPRemove, Path: "/tmp/a", Result: AuditResultSuccess},
+		{Event: AuditEventSFTPRename, Path: "/tmp/b", Target: "/tmp/c", Result: AuditResultFailure, Error: "Permission denied"},
+		{Event: AuditEventSFTPMkdir, Path: "/tmp/d", Result: AuditResultFailure, Error: "failure"},
+		{Event: AuditEventSFTPRmdir, Path: "/tmp/e", Result: AuditResultSuccess},
+		{Event: AuditEventSFTPRename, Path: "/tmp/f", Target: "/tmp/g", Result: AuditResultFailure, Error: "no response"},
+	}
+	if len(events) != len(want) {
+		t.Fatalf("events = %+v, want %+v", events, want)
+	}
+	for i := range want {
+		if events[i] != want[i] {
+			t.Errorf("events[%d] = %+v, want %+v", i, events[i], want[i])
+		}
+	}
+}
@@ -1,61 +1,109 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"github.com/creack/pty"
 	sshd "github.com/gliderlabs/ssh"
-	"golang.org/x/text/encoding/simplifiedchinese"
 	"io"
+	"os"
 	"os/exec"
+	"path/filepath"
 	"runtime"
 	"strings"
+	"syscall"
 )
 
 type (
 	SSH struct {
+		srv   *Server
+		log   Logger
+		audit *Auditor
 	}
 )
 
-func (h *SSH) Handle(sess sshd.Session) {
+func NewSSHHandler(srv *Server) *SSH {
+	return &SSH{
+		srv:   srv,
+		log:   srv.log,
+		audit: srv.audit,
+	}
+}
+
+func (h *SSH) Handle(s sshd.Session) {
+	sess := newActiveSession(s)
 	defer sess.Close()
+	agentEnv, closeAgent := h.forwardAgent(sess)
+	defer closeAgent()
+	x11Env, closeX11 := h.forwardX11(sess)
+	defer closeX11()
+	forwardEnv := append(agentEnv, x11Env...)
+	limits, closeLimits := h.sessionLimits(sess)
+	defer closeLimits()
+	if command, ok := certForceCommand(sess.Context()); ok {
+		// 证书指定了 force-command 时忽略客户端请求的命令、子系统和 shell
+		original := sess.RawCommand()
+		if sess.Subsystem() != "" {
+			original = sess.Subsystem()
+		}
+		h.exec(sess, shellCommand(command), command, limits, append(forwardEnv, envOriginalCommand+"="+original)...)
+		return
+	}
 	switch sess.Subsystem() {
 	case "sftp":
-		NewSFTPServer().Handle(sess)
+		NewSFTPServer(h.log, h.audit).Handle(sess)
 		return
 	}
 	if strings.HasPrefix(sess.RawCommand(), "scp ") {
-		NewSCPServer().Handle(sess)
+		NewSCPServer(h.log, h.audit).Handle(sess)
 		return
 	}
 	cmdList := sess.Command()
 	if len(cmdList) > 0 { // exec
-		cmd := exec.Command(cmdList[0], cmdList[1:]...)
-		cmd.Stdout = sess
-		cmd.Stderr = sess
-		cmd.Stdin = sess
-		err := cmd.Run()
-		if err != nil {
-			sess.Write([]byte(err.Error()))
-			sess.Exit(1)
-			return
-		}
+		h.exec(sess, cmdList, sess.RawCommand(), limits, forwardEnv...)
 		return
 	}
 
-	_, _, isPty := sess.Pty()
+	ptyReq, winCh, isPty := sess.Pty()
 	if isPty && runtime.GOOS != "windows" { // pty
-		ptmx, err := pty.Start(exec.Command("bash"))
+		log := sessionLogger(h.log, sess, "pty")
+		log.Info("start pty shell")
+		defer log.Info("end pty shell")
+		defer metrics.SessionStart(SessionTypeShell)()
+		recorder, err := NewRecorder(h.srv.Config().Record, sess, ptyReq)
+		if err != nil {
+			log.Error("create recorder failed", "err", err)
+		}
+		defer recorder.Close()
+		defer sess.WarnOnIdle()()
+		last := h.recordLogin(sess, log)
+		if err = writeLoginMessage(io.MultiWriter(sess, recorder.Output()), h.srv.Config().Login, last); err != nil {
+			log.Warn("write motd failed", "err", err)
+		}
+		shell := exec.Command("bash")
+		shell.Env = append(sessionEnv(sess), forwardEnv...)
+		if err = limits.Apply(shell); err != nil {
+			log.Error("apply resource limits failed", "err", err)
+			exitSession(sess, err, "")
+			return
+		}
+		ptmx, err := pty.StartWithSize(shell, &pty.Winsize{
+			Rows: uint16(ptyReq.Window.Height),
+			Cols: uint16(ptyReq.Window.Width),
+		})
 		if err != nil {
+			log.Error("start pty failed", "err", err)
 			sess.Write([]byte(err.Error()))
 			sess.Exit(1)
 			return
 		}
 		defer ptmx.Close()
-		handleResize(ptmx)
+		handleResize(ptmx, winCh, recorder.Resize)
+		codec := h.newCodec(sess, log)
 		go func() {
-			_, _ = io.Copy(ptmx, sess)
+			_, _ = io.Copy(ptmx, codec.Input(io.TeeReader(sess, recorder.Input())))
 		}()
-		_, _ = io.Copy(sess, ptmx)
+		_, _ = io.Copy(io.MultiWriter(sess, recorder.Output()), codec.OutputReader(ptmx))
 		return
 	}
 
@@ -68,25 +116,180 @@ func (h *SSH) Handle(sess sshd.Session) {
 		}
 	}
 
-	fmt.Println("exec: " + strings.Join(cmdList, " "))
+	log := sessionLogger(h.log, sess, "shell")
+	log.Info("start shell", "command", strings.Join(cmdList, " "))
+	defer log.Info("end shell")
+	defer metrics.SessionStart(SessionTypeShell)()
 	cmd := exec.Command(cmdList[0], cmdList[1:]...)
-	in, _ := cmd.StdinPipe()
-	out, _ := cmd.StdoutPipe()
-	if runtime.GOOS == "windows" {
-		out = io.NopCloser(simplifiedchinese.GB18030.NewDecoder().Reader(out))
+	cmd.Env = append(sessionEnv(sess), forwardEnv...)
+	if err := limits.Apply(cmd); err != nil {
+		log.Error("apply resource limits failed", "err", err)
+		exitSession(sess, err, "")
+		return
 	}
+	err := runCommand(sess, cmd, h.newCodec(sess, log), nil)
+	if err != nil {
+		log.Warn("shell failed", "err", err)
+	}
+	exitSession(sess, err, "")
+}
+
+// exec 执行命令，limits 为资源限制，env 为额外的环境变量
+func (h *SSH) exec(sess sshd.Session, cmdList []string, rawCommand string, limits *procLimits, env ...string) {
+	log := sessionLogger(h.log, sess, "exec")
+	log.Info("exec", "command", rawCommand)
+	h.audit.Session(sess, AuditEvent{Event: AuditEventExec, Command: rawCommand})
+	defer metrics.SessionStart(SessionTypeExec)()
+	limit, err := newExecLimit(h.srv.Config().Exec, sess)
+	if err != nil {
+		exitSession(sess, err, "")
+		return
+	}
+	cmd := exec.Command(cmdList[0], cmdList[1:]...)
+	cmd.Env = append(sessionEnv(sess), env...)
+	if err := limits.Apply(cmd); err != nil {
+		log.Error("apply resource limits failed", "err", err)
+		exitSession(sess, err, "")
+		return
+	}
+	limit.Prepare(cmd)
+	err = runCommand(sess, cmd, h.newCodec(sess, log), limit)
+	reason := limit.Reason()
+	if reason != "" {
+		log.Warn("exec terminated", "reason", reason)
+	} else if err != nil {
+		log.Warn("exec failed", "err", err)
+	} else {
+		log.Debug("exec finished")
+	}
+	exitSession(sess, err, reason)
+}
+
+// forwardAgent 客户端请求了 agent 转发时创建本地 socket，返回需要传给命令的 SSH_AUTH_SOCK，
+// 返回的函数在会话结束时关闭 socket 并删除临时目录
+func (h *SSH) forwardAgent(sess sshd.Session) ([]string, func()) {
+	if !sshd.AgentRequested(sess) {
+		return nil, func() {}
+	}
+	log := sessionLogger(h.log, sess, "agent")
+	cfg := h.srv.Config()
+	if account := cfg.LookupAccount(sess.User()); account != nil && account.DisableAgentForwarding {
+		log.Info("agent forwarding disabled for account")
+		return nil, func() {}
+	}
+	if !certPermits(sess.Context(), certExtPermitAgentForwarding) {
+		log.Info("agent forwarding not permitted by certificate")
+		return nil, func() {}
+	}
+	l, err := sshd.NewAgentListener()
+	if err != nil {
+		log.Error("create agent listener failed", "err", err)
+		return nil, func() {}
+	}
+	sock := l.Addr().String()
+	go sshd.ForwardAgentConnections(l, sess)
+	log.Debug("agent forwarding", "socket", sock)
+	return []string{"SSH_AUTH_SOCK=" + sock}, func() {
+		_ = l.Close()
+		_ = os.RemoveAll(filepath.Dir(sock))
+	}
+}
+
+// newCodec 按配置创建会话的字符集转换，配置错误时不转换
+func (h *SSH) newCodec(sess sshd.Session, log Logger) *sessionCodec {
+	cfg := h.srv.Config()
+	enc, err := cfg.SessionEncoding(sess.User())
+	if err != nil {
+		log.Warn("load encoding failed, using utf-8", "err", err)
+		return nil
+	}
+	return newSessionCodec(enc)
+}
+
+// runCommand 运行命令并等待结束，stdout 和 stderr 分别写入不同的流，
+// 客户端发送 EOF 时关闭命令的 stdin，limit 为 nil 时不限制运行时间和输出
+func runCommand(sess sshd.Session, cmd *exec.Cmd, codec *sessionCodec, limit *execLimit) error {
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return err
+	}
+	cmd.Stdout = limit.Writer(codec.Output(sess))
+	cmd.Stderr = limit.Writer(codec.Output(sess.Stderr()))
+	defer codec.Close()
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	limit.Start(cmd)
+	defer limit.Stop()
 	go func() {
-		_, _ = io.Copy(in, sess)
-	}()
-	go func() {
-		_, _ = io.Copy(sess, out)
+		_, _ = io.Copy(stdin, codec.Input(sess))
+		_ = stdin.Close()
 	}()
+	return cmd.Wait()
+}
 
-	err := cmd.Run()
-	if err != nil {
-		sess.Write([]byte(err.Error()))
-		sess.Exit(1)
+// exitSession 向客户端返回命令的退出码，命令被信号终止时返回 exit-signal，未能启动时将错误写入 stderr。
+// reason 为服务端主动终止命令的原因，同时写入 stderr 和 exit-signal
+func exitSession(sess sshd.Session, err error, reason string) {
+	if reason != "" {
+		_, _ = fmt.Fprintf(sess.Stderr(), "ssh_toolkits: %s\n", reason)
+	}
+	if err == nil {
+		_ = sess.Exit(0)
 		return
 	}
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		if exitErr.ExitCode() >= 0 {
+			_ = sess.Exit(exitErr.ExitCode())
+			return
+		}
+		if status, ok := exitErr.Sys().(syscall.WaitStatus); ok && status.Signaled() {
+			if sig := sshSignal(status.Signal()); sig != "" {
+				exitSignal(sess, sig, reason)
+				return
+			}
+		}
+	}
+	_, _ = fmt.Fprintln(sess.Stderr(), err.Error())
+	_ = sess.Exit(1)
+}
+
+// sessionEnv 返回会话中命令的环境变量，认证后端返回的账号属性以 SSH_TOOLKITS_ATTR_<名称> 传入
+func sessionEnv(sess sshd.Session) []string {
+	env := make([]string, 0)
+	for _, kv := range os.Environ() {
+		// 不把服务进程自己的 agent、X 显示和 SSH_TOOLKITS_* 配置（可能包含密码）暴露给会话，
+		// 同时避免会话伪造下面的 SSH_TOOLKITS_ATTR_*
+		if strings.HasPrefix(kv, EnvPrefix) || strings.HasPrefix(kv, "SSH_AUTH_SOCK=") ||
+			strings.HasPrefix(kv, "DISPLAY=") || strings.HasPrefix(kv, "XAUTHORITY=") {
+			continue
+		}
+		env = append(env, kv)
+	}
+	result, ok := sess.Context().Value(ctxKeyAuthResult).(*AuthResult)
+	if !ok || result == nil {
+		return env
+	}
+	for key, val := range result.Attributes {
+		name := strings.Map(func(c rune) rune {
+			if c >= 'a' && c <= 'z' {
+				return c - 'a' + 'A'
+			}
+			if (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9') {
+				return c
+			}
+			return '_'
+		}, key)
+		env = append(env, EnvPrefix+"ATTR_"+name+"="+val)
+	}
+	return env
+}
 
+// shellCommand 返回通过 shell 执行一行命令的参数
+func shellCommand(command string) []string {
+	if runtime.GOOS == "windows" {
+		return []string{"powershell", "-Command", command}
+	}
+	return []string{"bash", "-c", command}
 }
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// systemd 传递的第一个文件描述符
+const sdListenFdsStart = 3
+
+// InheritedListeners 获取 systemd socket activation 传入的监听(LISTEN_FDS/LISTEN_PID)，
+// 没有传入时返回空列表
+func InheritedListeners(addrs []ListenAddr, log Logger) ([]net.Listener, error) {
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return nil, nil
+	}
+	n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || n <= 0 {
+		return nil, nil
+	}
+	names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+	// 避免传递给子进程
+	_ = os.Unsetenv("LISTEN_PID")
+	_ = os.Unsetenv("LISTEN_FDS")
+	_ = os.Unsetenv("LISTEN_FDNAMES")
+
+	listeners := make([]net.Listener, 0, n)
+	for i := 0; i < n; i++ {
+		fd := sdListenFdsStart + i
+		syscall.CloseOnExec(fd)
+		name := ""
+		if i < len(names) {
+			name = names[i]
+		}
+		f := os.NewFile(uintptr(fd), name)
+		l, err := net.FileListener(f)
+		_ = f.Close()
+		if err != nil {
+			for _, opened := range listeners {
+				_ = opened.Close()
+			}
+			return nil, errors.New(fmt.Sprintf("inherit listener fd %d err:%s", fd, err.Error()))
+		}
+		addr := matchListenAddr(addrs, name, l)
+		if addr == nil {
+			// 配置了按地址限制认证方式时，无法确定该监听的限制，不能默认允许所有方式
+			if restrictsAuth(addrs) {
+				_ = l.Close()
+				for _, opened := range listeners {
+					_ = opened.Close()
+				}
+				return nil, errors.New(fmt.Sprintf("inherited listener fd %d (name %q, addr %s) matches no Listen entry",
+					fd, name, l.Addr().String()))
+			}
+			log.Warn("inherited listener matches no Listen entry, all auth methods allowed", "addr", l.Addr().String(), "name", name)
+			addr = &ListenAddr{Address: l.Addr().String(), Name: name}
+		}
+		log.Info("listen inherited", "network", l.Addr().Network(), "addr", l.Addr().String(), "name", name)
+		listeners = append(listeners, &addrListener{Listener: l, addr: addr})
+	}
+	return listeners, nil
+}
+
+// SdNotify 向 systemd 发送状态通知，如 READY=1、STOPPING=1，未由 systemd 启动时忽略
+func SdNotify(state string) error {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if socket == "" {
+		return nil
+	}
+	if strings.HasPrefix(socket, "@") { // 抽象命名空间
+		socket = "\x00" + socket[1:]
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_, err = conn.Write([]byte(state))
+	return err
+}
@@ -0,0 +1,13 @@
+package main
+
+import (
+	"net"
+)
+
+func InheritedListeners(addrs []ListenAddr, log Logger) ([]net.Listener, error) {
+	return nil, nil
+}
+
+func SdNotify(state string) error {
+	return nil
+}
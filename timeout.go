@@ -0,0 +1,314 @@
+package main
+
+import (
+	"fmt"
+	sshd "github.com/gliderlabs/ssh"
+	"golang.org/x/crypto/ssh"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const keepaliveRequestType = "keepalive@openssh.com"
+
+type (
+	// TimeoutConfig 连接超时配置，时间单位为秒，负数表示不限制
+	TimeoutConfig struct {
+		IdleTimeout         int `json:"IdleTimeout"`         // 会话没有任何输入输出超过该时间后断开，认证前从建立连接开始计算
+		MaxTimeout          int `json:"MaxTimeout"`          // 连接建立后的最长时间
+		IdleWarning         int `json:"IdleWarning"`         // 因空闲断开前多少秒在交互式会话中提示
+		ClientAliveInterval int `json:"ClientAliveInterval"` // 向客户端发送 keepalive 的间隔，0 表示不发送
+		ClientAliveCountMax int `json:"ClientAliveCountMax"` // 连续多少次 keepalive 没有回应后断开
+	}
+
+	// connActivity 记录连接中所有会话最近一次输入输出的时间，以及需要接收空闲提示的终端。
+	// sshd.Context 的 SetValue 不能与其他 goroutine 的读取并发，连接的 goroutine 只使用这里保存的
+	// done、认证后的用户、会话 ID 和连接，不访问 sshd.Context
+	connActivity struct {
+		last      int64           // UnixNano，原子读写
+		done      <-chan struct{} // 连接的 ctx.Done()，在第一次 SetValue 之前取得
+		mu        sync.Mutex
+		terminals map[io.Writer]struct{}
+		user      string
+		session   string
+		conn      ssh.Conn
+		closers   []func()
+		closed    bool
+	}
+
+	// activeSession 读写时更新连接的活动时间，keepalive 不算作活动
+	activeSession struct {
+		sshd.Session
+		act *connActivity
+	}
+	activeStderr struct {
+		io.ReadWriter
+		act *connActivity
+	}
+)
+
+// ctxKeyActivity 连接的 *connActivity
+var ctxKeyActivity = &struct{ name string }{"activity"}
+
+func (c *TimeoutConfig) SetDefault() {
+	if c.IdleTimeout == 0 {
+		c.IdleTimeout = 12 * 60 * 60
+	}
+	if c.MaxTimeout == 0 {
+		c.MaxTimeout = 12 * 60 * 60
+	}
+	if c.IdleWarning == 0 {
+		c.IdleWarning = 60
+	}
+	if c.ClientAliveCountMax == 0 {
+		c.ClientAliveCountMax = 3
+	}
+}
+
+// ConnTimeout 返回用户的空闲超时和最长连接时间，账号中的设置优先，未认证时 user 为空
+func (c *Config) ConnTimeout(user string) (idle, max time.Duration) {
+	idle, max = seconds(c.Timeout.IdleTimeout), seconds(c.Timeout.MaxTimeout)
+	if account := c.LookupAccount(user); user != "" && account != nil {
+		if account.IdleTimeout != 0 {
+			idle = seconds(account.IdleTimeout)
+		}
+		if account.MaxTimeout != 0 {
+			max = seconds(account.MaxTimeout)
+		}
+	}
+	return idle, max
+}
+
+// seconds 负数表示不限制，返回 0
+func seconds(n int) time.Duration {
+	if n < 0 {
+		return 0
+	}
+	return time.Duration(n) * time.Second
+}
+
+func newConnActivity(now time.Time, done <-chan struct{}) *connActivity {
+	return &connActivity{last: now.UnixNano(), done: done, terminals: make(map[io.Writer]struct{})}
+}
+
+func (a *connActivity) Touch() {
+	if a != nil {
+		atomic.StoreInt64(&a.last, time.Now().UnixNano())
+	}
+}
+
+func (a *connActivity) Idle(now time.Time) time.Duration {
+	return now.Sub(time.Unix(0, atomic.LoadInt64(&a.last)))
+}
+
+// AddTerminal 注册交互式会话用于空闲提示，返回的函数在会话结束时调用
+func (a *connActivity) AddTerminal(w io.Writer) func() {
+	if a == nil {
+		return func() {}
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.terminals[w] = struct{}{}
+	return func() {
+		a.mu.Lock()
+		defer a.mu.Unlock()
+		delete(a.terminals, w)
+	}
+}
+
+// SetUser 认证成功后在握手的 goroutine 中调用
+func (a *connActivity) SetUser(user, session string) {
+	if a == nil {
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.user = user
+	a.session = session
+}
+
+// SetConn 握手完成后调用，用于发送 keepalive
+func (a *connActivity) SetConn(conn ssh.Conn) {
+	if a == nil {
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.conn = conn
+}
+
+// Authenticated 返回认证成功的用户和连接，握手完成前 conn 为 nil
+func (a *connActivity) Authenticated() (string, ssh.Conn) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.user, a.conn
+}
+
+// OnClose 注册连接关闭时调用的函数，连接已关闭时立即调用
+func (a *connActivity) OnClose(fn func()) {
+	if a == nil {
+		fn()
+		return
+	}
+	a.mu.Lock()
+	if !a.closed {
+		a.closers = append(a.closers, fn)
+		a.mu.Unlock()
+		return
+	}
+	a.mu.Unlock()
+	fn()
+}
+
+// Close 连接关闭时调用，依次调用 OnClose 注册的函数
+func (a *connActivity) Close() {
+	a.mu.Lock()
+	closers := a.closers
+	a.closers, a.closed = nil, true
+	a.mu.Unlock()
+	for _, fn := range closers {
+		fn()
+	}
+}
+
+// Session 返回会话 ID 的前 12 位，认证前为空
+func (a *connActivity) Session() string {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.session
+}
+
+// Warn 向所有交互式会话输出提示，不更新活动时间
+func (a *connActivity) Warn(msg string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for w := range a.terminals {
+		_, _ = io.WriteString(w, "\r\n"+msg+"\r\n")
+	}
+}
+
+func newActiveSession(sess sshd.Session) *activeSession {
+	act, _ := sess.Context().Value(ctxKeyActivity).(*connActivity)
+	return &activeSession{Session: sess, act: act}
+}
+
+func (s *activeSession) Read(p []byte) (int, error) {
+	n, err := s.Session.Read(p)
+	if n > 0 {
+		s.act.Touch()
+	}
+	return n, err
+}
+
+func (s *activeSession) Write(p []byte) (int, error) {
+	s.act.Touch()
+	return s.Session.Write(p)
+}
+
+func (s *activeSession) Stderr() io.ReadWriter {
+	return &activeStderr{ReadWriter: s.Session.Stderr(), act: s.act}
+}
+
+// WarnOnIdle 空闲断开前在该会话中提示，提示直接写入原始会话，不算作活动
+func (s *activeSession) WarnOnIdle() func() {
+	return s.act.AddTerminal(s.Session)
+}
+
+func (s *activeStderr) Read(p []byte) (int, error) {
+	n, err := s.ReadWriter.Read(p)
+	if n > 0 {
+		s.act.Touch()
+	}
+	return n, err
+}
+
+func (s *activeStderr) Write(p []byte) (int, error) {
+	s.act.Touch()
+	return s.ReadWriter.Write(p)
+}
+
+// watchConn 检查认证期限、连接的空闲时间和最长时间，超时后关闭连接，连接关闭后退出。
+// 认证后按账号的配置计算，配置重新加载后同样生效
+func (s *Server) watchConn(conn net.Conn, act *connActivity) {
+	start := time.Now()
+	ticker := time.NewTicker(s.watchInterval)
+	defer ticker.Stop()
+	var warned bool
+	go s.keepalive(conn, act)
+	for {
+		select {
+		case <-act.done:
+			return
+		case now := <-ticker.C:
+			cfg := s.Config()
+			user, _ := act.Authenticated()
+			if grace := seconds(cfg.BruteForce.LoginGraceTime); user == "" && grace > 0 && now.Sub(start) >= grace {
+				s.closeConn(conn, act, "login grace timeout", "timeout", grace)
+				return
+			}
+			idleTimeout, maxTimeout := cfg.ConnTimeout(user)
+			if maxTimeout > 0 && now.Sub(start) >= maxTimeout {
+				s.closeConn(conn, act, "max timeout", "user", user, "timeout", maxTimeout)
+				return
+			}
+			if idleTimeout <= 0 {
+				continue
+			}
+			idle := act.Idle(now)
+			if idle >= idleTimeout {
+				s.closeConn(conn, act, "idle timeout", "user", user, "timeout", idleTimeout)
+				return
+			}
+			warning := seconds(cfg.Timeout.IdleWarning)
+			if idle < idleTimeout-warning {
+				warned = false
+			} else if !warned && warning > 0 {
+				warned = true
+				act.Warn(fmt.Sprintf("*** idle for %s, the connection will be closed in %s ***",
+					idle.Truncate(time.Second), (idleTimeout - idle).Round(time.Second)))
+			}
+		}
+	}
+}
+
+// keepalive 每隔 ClientAliveInterval 发送一次 keepalive@openssh.com，
+// 连续 ClientAliveCountMax 次没有回应时认为客户端已断开
+func (s *Server) keepalive(conn net.Conn, act *connActivity) {
+	var missed int32
+	for {
+		interval := seconds(s.Config().Timeout.ClientAliveInterval)
+		if interval <= 0 {
+			// 未开启时定期检查配置是否变更
+			interval = 10 * time.Second
+		}
+		select {
+		case <-act.done:
+			return
+		case <-time.After(interval):
+		}
+		cfg := s.Config().Timeout
+		user, sshConn := act.Authenticated()
+		if cfg.ClientAliveInterval <= 0 || sshConn == nil {
+			atomic.StoreInt32(&missed, 0)
+			continue
+		}
+		if n := atomic.AddInt32(&missed, 1); int(n) > cfg.ClientAliveCountMax {
+			s.closeConn(conn, act, "client alive timeout", "user", user, "missed", n-1)
+			return
+		}
+		go func() {
+			// 客户端不认识该请求时也会回复失败，收到任何回复都说明连接正常
+			if _, _, err := sshConn.SendRequest(keepaliveRequestType, true, nil); err == nil {
+				atomic.StoreInt32(&missed, 0)
+			}
+		}()
+	}
+}
+
+func (s *Server) closeConn(conn net.Conn, act *connActivity, reason string, args ...interface{}) {
+	s.log.Info("close connection", append([]interface{}{"session", act.Session(),
+		"remote", conn.RemoteAddr().String(), "reason", reason}, args...)...)
+	_ = conn.Close()
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"golang.org/x/crypto/ssh"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// newTestServer 在随机端口上启动服务，watchConn 按 interval 检查超时，测试结束时关闭
+func newTestServer(t *testing.T, cfg Config, interval time.Duration) (*Server, string) {
+	t.Helper()
+	cfg.SetDefault()
+	if err := cfg.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	s, err := NewServer(cfg, nil, NewLogger(io.Discard, cfg.Log))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.watchInterval = interval
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		_ = s.srv.Serve(l)
+	}()
+	t.Cleanup(func() {
+		_ = s.srv.Close()
+	})
+	return s, l.Addr().String()
+}
+
+func dialTestServer(addr, user, password string) (*ssh.Client, error) {
+	return ssh.Dial("tcp", addr, &ssh.ClientConfig{
+		User:            user,
+		Auth:            []ssh.AuthMethod{ssh.Password(password)},
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+		Timeout:         5 * time.Second,
+	})
+}
+
+// TestWatchConnDuringAuth 认证过程中 watchConn 和 keepalive 持续检查连接，
+// 需要配合 go test -race 确认它们不会与握手中的 ctx.SetValue 并发访问 ctx
+func TestWatchConnDuringAuth(t *testing.T) {
+	cfg := Config{}
+	cfg.Timeout.ClientAliveInterval = 1
+	_, addr := newTestServer(t, cfg, time.Millisecond)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 5; j++ {
+				client, err := dialTestServer(addr, "tools", "tools")
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				time.Sleep(5 * time.Millisecond)
+				_ = client.Close()
+			}
+		}()
+	}
+	wg.Wait()
+
+	if _, err := dialTestServer(addr, "tools", "wrong"); err == nil {
+		t.Fatal("wrong password accepted")
+	}
+}
+
+func TestLoginGraceTime(t *testing.T) {
+	cfg := Config{}
+	cfg.BruteForce.LoginGraceTime = 1
+	_, addr := newTestServer(t, cfg, 10*time.Millisecond)
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	start := time.Now()
+	if _, err := io.Copy(io.Discard, conn); err != nil {
+		t.Fatalf("connection not closed by the server: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < 500*time.Millisecond {
+		t.Fatalf("closed after %s, before LoginGraceTime", elapsed)
+	}
+}
@@ -2,21 +2,23 @@ package main
 
 import (
 	"github.com/creack/pty"
+	sshd "github.com/gliderlabs/ssh"
 	"os"
-	"os/signal"
+	"os/exec"
 	"syscall"
 	"time"
 )
 
-func handleResize(ptmx *os.File) {
-	ch := make(chan os.Signal, 1)
-	signal.Notify(ch, syscall.SIGWINCH)
+// handleResize 将客户端的窗口大小同步到 pty，winCh 关闭时返回
+func handleResize(ptmx *os.File, winCh <-chan sshd.Window, onResize func(sshd.Window)) {
 	go func() {
-		for range ch {
-			_ = pty.InheritSize(os.Stdin, ptmx)
+		for win := range winCh {
+			_ = pty.Setsize(ptmx, &pty.Winsize{Rows: uint16(win.Height), Cols: uint16(win.Width)})
+			if onResize != nil {
+				onResize(win)
+			}
 		}
 	}()
-	ch <- syscall.SIGWINCH
 }
 
 func getAccessTime(stat os.FileInfo) time.Time {
@@ -26,3 +28,16 @@ func getAccessTime(stat os.FileInfo) time.Time {
 	}
 	return time.Now()
 }
+
+// setProcessGroup 命令在新的进程组中运行
+func setProcessGroup(cmd *exec.Cmd) {
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.Setpgid = true
+}
+
+// signalProcessGroup 向进程所在的整个进程组发送信号
+func signalProcessGroup(p *os.Process, sig syscall.Signal) error {
+	return syscall.Kill(-p.Pid, sig)
+}
@@ -1,12 +1,14 @@
 package main
 
 import (
+	sshd "github.com/gliderlabs/ssh"
 	"os"
+	"os/exec"
 	"syscall"
 	"time"
 )
 
-func handleResize(ptmx *os.File) {
+func handleResize(ptmx *os.File, winCh <-chan sshd.Window, onResize func(sshd.Window)) {
 
 }
 
@@ -17,3 +19,12 @@ func getAccessTime(stat os.FileInfo) time.Time {
 	}
 	return time.Now()
 }
+
+func setProcessGroup(cmd *exec.Cmd) {
+
+}
+
+// signalProcessGroup Windows 上没有进程组信号，直接结束进程
+func signalProcessGroup(p *os.Process, sig syscall.Signal) error {
+	return p.Kill()
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// rfc6238Key RFC 6238 附录 B 中 SHA1 使用的密钥，base32 为 GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ
+const rfc6238Key = "12345678901234567890"
+
+// TestTOTPCode 使用 RFC 6238 附录 B 的 SHA1 测试向量，8 位验证码取后 6 位
+func TestTOTPCode(t *testing.T) {
+	tests := []struct {
+		unix int64
+		code string
+	}{
+		{59, "287082"},          // 94287082
+		{1111111109, "081804"},  // 07081804
+		{1111111111, "050471"},  // 14050471
+		{1234567890, "005924"},  // 89005924
+		{2000000000, "279037"},  // 69279037
+		{20000000000, "353130"}, // 65353130
+	}
+	for _, tt := range tests {
+		if got := totpCode([]byte(rfc6238Key), tt.unix/totpPeriod); got != tt.code {
+			t.Errorf("totpCode(T=%d) = %s, want %s", tt.unix, got, tt.code)
+		}
+	}
+}
+
+// resetTOTPUsed 清空已使用的验证码记录，测试可以重复运行
+func resetTOTPUsed() {
+	totpUsedMu.Lock()
+	defer totpUsedMu.Unlock()
+	totpUsed = map[string]int64{}
+}
+
+func TestVerifyTOTP(t *testing.T) {
+	resetTOTPUsed()
+	secret := totpEncoding.EncodeToString([]byte(rfc6238Key))
+	if secret != "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ" {
+		t.Fatalf("secret = %s", secret)
+	}
+	now := time.Unix(1111111111, 0)
+	tests := []struct {
+		name string
+		user string
+		code string
+		ok   bool
+	}{
+		{"current step", "current", "050471", true},
+		{"with spaces", "spaces", " 050471 ", true},
+		{"wrong code", "wrong", "123456", false},
+		{"eight digits", "digits", "14050471", false},
+		{"previous step", "previous", totpCode([]byte(rfc6238Key), now.Unix()/totpPeriod-1), true},
+		{"next step", "next", totpCode([]byte(rfc6238Key), now.Unix()/totpPeriod+1), true},
+		{"two steps behind", "behind", totpCode([]byte(rfc6238Key), now.Unix()/totpPeriod-2), false},
+		{"two steps ahead", "ahead", totpCode([]byte(rfc6238Key), now.Unix()/totpPeriod+2), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ok, err := VerifyTOTP(secret, "verify-"+tt.user, tt.code, now)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if ok != tt.ok {
+				t.Fatalf("VerifyTOTP(%q) = %v, want %v", tt.code, ok, tt.ok)
+			}
+		})
+	}
+
+	if _, err := VerifyTOTP("not base32!", "verify-invalid", "050471", now); err == nil {
+		t.Fatal("invalid secret accepted")
+	}
+}
+
+// TestVerifyTOTPReplay 同一周期的验证码只能使用一次，使用过后更早周期的验证码也失效
+func TestVerifyTOTPReplay(t *testing.T) {
+	resetTOTPUsed()
+	secret := totpEncoding.EncodeToString([]byte(rfc6238Key))
+	now := time.Unix(1111111111, 0)
+	step := now.Unix() / totpPeriod
+	verify := func(user string, step int64) bool {
+		ok, err := VerifyTOTP(secret, user, totpCode([]byte(rfc6238Key), step), now)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ok
+	}
+	if !verify("replay", step) {
+		t.Fatal("first use rejected")
+	}
+	if verify("replay", step) {
+		t.Fatal("replayed code accepted")
+	}
+	if verify("replay", step-1) {
+		t.Fatal("code of an earlier step accepted after a later one was used")
+	}
+	if !verify("replay", step+1) {
+		t.Fatal("code of a later step rejected")
+	}
+	// 其他用户不受影响
+	if !verify("replay-other", step) {
+		t.Fatal("code rejected for another user")
+	}
+}
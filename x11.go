@@ -0,0 +1,230 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	sshd "github.com/gliderlabs/ssh"
+	"golang.org/x/crypto/ssh"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"sync"
+)
+
+const (
+	x11RequestType = "x11-req"
+	x11ChannelType = "x11"
+	x11BasePort    = 6000
+	x11MaxDisplays = 1000
+
+	certExtPermitX11Forwarding = "permit-X11-forwarding"
+)
+
+type (
+	// X11Config X11 转发配置，默认关闭
+	X11Config struct {
+		Enable        bool `json:"Enable"`
+		DisplayOffset int  `json:"DisplayOffset"` // 第一个可用的 DISPLAY 编号，与 OpenSSH 的 X11DisplayOffset 相同
+	}
+
+	// x11Request x11-req 请求内容，见 RFC 4254 6.3.1
+	x11Request struct {
+		SingleConnection bool
+		AuthProtocol     string
+		AuthCookie       string
+		ScreenNumber     uint32
+	}
+	x11ChannelData struct {
+		OriginatorAddress string
+		OriginatorPort    uint32
+	}
+
+	// channelContext 每个 session channel 独立的上下文，SetValue 只对当前 channel 生效，
+	// 读取时找不到再查连接的上下文
+	channelContext struct {
+		sshd.Context
+		mu     sync.Mutex
+		values map[interface{}]interface{}
+	}
+
+	// x11NewChannel 在 gliderlabs 处理 session 请求之前拦截 x11-req
+	x11NewChannel struct {
+		ssh.NewChannel
+		ctx   sshd.Context
+		onX11 func(ctx sshd.Context, req x11Request) bool
+	}
+)
+
+// ctxKeyX11Request 当前 channel 的 *x11Request
+var ctxKeyX11Request = &struct{ name string }{"x11-req"}
+
+func (c *X11Config) SetDefault() {
+	if c.DisplayOffset == 0 {
+		c.DisplayOffset = 10
+	}
+}
+
+func newChannelContext(ctx sshd.Context) *channelContext {
+	return &channelContext{Context: ctx, values: make(map[interface{}]interface{})}
+}
+
+func (c *channelContext) Value(key interface{}) interface{} {
+	c.mu.Lock()
+	v, ok := c.values[key]
+	c.mu.Unlock()
+	if ok {
+		return v
+	}
+	return c.Context.Value(key)
+}
+
+func (c *channelContext) SetValue(key, value interface{}) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.values[key] = value
+}
+
+// sessionChannelHandler 替代 gliderlabs 默认的 session 处理，增加会话数限制和 x11-req 支持
+func (s *Server) sessionChannelHandler(srv *sshd.Server, conn *ssh.ServerConn, newChan ssh.NewChannel, ctx sshd.Context) {
+	if act, ok := ctx.Value(ctxKeyActivity).(*connActivity); ok {
+		act.SetConn(conn)
+	}
+	release := s.acquireSession(ctx, conn, newChan)
+	if release == nil {
+		return
+	}
+	defer release()
+	chCtx := newChannelContext(ctx)
+	sshd.DefaultSessionHandler(srv, conn, &x11NewChannel{NewChannel: newChan, ctx: chCtx, onX11: s.x11Request}, chCtx)
+}
+
+// x11Request 判断是否允许 X11 转发，允许时记录到 channel 的上下文
+func (s *Server) x11Request(ctx sshd.Context, req x11Request) bool {
+	cfg := s.Config()
+	if !cfg.X11.Enable || !certPermits(ctx, certExtPermitX11Forwarding) {
+		return false
+	}
+	if account := cfg.LookupAccount(ctx.User()); account != nil && account.DisableX11Forwarding {
+		return false
+	}
+	ctx.SetValue(ctxKeyX11Request, &req)
+	return true
+}
+
+func (c *x11NewChannel) Accept() (ssh.Channel, <-chan *ssh.Request, error) {
+	ch, reqs, err := c.NewChannel.Accept()
+	if err != nil {
+		return ch, reqs, err
+	}
+	out := make(chan *ssh.Request)
+	go func() {
+		defer close(out)
+		for req := range reqs {
+			if req.Type != x11RequestType {
+				out <- req
+				continue
+			}
+			var x11 x11Request
+			ok := ssh.Unmarshal(req.Payload, &x11) == nil && c.onX11(c.ctx, x11)
+			if req.WantReply {
+				_ = req.Reply(ok, nil)
+			}
+		}
+	}()
+	return ch, out, nil
+}
+
+// forwardX11 客户端请求了 X11 转发时监听本地 DISPLAY 端口，将每个 X 连接通过 x11 channel 转发给客户端，
+// 返回需要传给命令的 DISPLAY、XAUTHORITY 和会话结束时调用的清理函数
+func (h *SSH) forwardX11(sess sshd.Session) ([]string, func()) {
+	req, ok := sess.Context().Value(ctxKeyX11Request).(*x11Request)
+	if !ok {
+		return nil, func() {}
+	}
+	log := sessionLogger(h.log, sess, "x11")
+	cfg := h.srv.Config()
+	l, display, err := listenX11(cfg.X11.DisplayOffset)
+	if err != nil {
+		log.Error("listen x11 display failed", "err", err)
+		return nil, func() {}
+	}
+	env := []string{fmt.Sprintf("DISPLAY=localhost:%d.%d", display, req.ScreenNumber)}
+	dir, err := os.MkdirTemp("", "ssh-x11")
+	if err == nil {
+		// 使用会话独立的 Xauthority 文件，不修改用户自己的 ~/.Xauthority
+		xauthFile := filepath.Join(dir, "xauth")
+		xauth := exec.Command("xauth", "-q", "-f", xauthFile, "add",
+			fmt.Sprintf("unix:%d.%d", display, req.ScreenNumber), req.AuthProtocol, req.AuthCookie)
+		if out, err := xauth.CombinedOutput(); err != nil {
+			log.Warn("xauth add failed", "err", err, "output", string(out))
+		} else {
+			env = append(env, "XAUTHORITY="+xauthFile)
+		}
+	}
+	conn := sess.Context().Value(sshd.ContextKeyConn).(ssh.Conn)
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			if req.SingleConnection {
+				_ = l.Close()
+			}
+			go forwardX11Conn(conn, c, log)
+		}
+	}()
+	log.Info("x11 forwarding", "display", display)
+	return env, func() {
+		_ = l.Close()
+		if dir != "" {
+			_ = os.RemoveAll(dir)
+		}
+	}
+}
+
+// listenX11 从 offset 开始查找可用的 DISPLAY 编号并监听 127.0.0.1:6000+编号
+func listenX11(offset int) (net.Listener, int, error) {
+	for display := offset; display < offset+x11MaxDisplays; display++ {
+		l, err := net.Listen("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(x11BasePort+display)))
+		if err == nil {
+			return l, display, nil
+		}
+	}
+	return nil, 0, errors.New("no free x11 display")
+}
+
+func forwardX11Conn(conn ssh.Conn, c net.Conn, log Logger) {
+	defer c.Close()
+	addr, _ := c.RemoteAddr().(*net.TCPAddr)
+	data := x11ChannelData{OriginatorAddress: "127.0.0.1"}
+	if addr != nil {
+		data.OriginatorAddress = addr.IP.String()
+		data.OriginatorPort = uint32(addr.Port)
+	}
+	channel, reqs, err := conn.OpenChannel(x11ChannelType, ssh.Marshal(&data))
+	if err != nil {
+		log.Warn("open x11 channel failed", "err", err)
+		return
+	}
+	defer channel.Close()
+	go ssh.DiscardRequests(reqs)
+	done := make(chan struct{}, 2)
+	go func() {
+		_, _ = io.Copy(c, channel)
+		if tcp, ok := c.(*net.TCPConn); ok {
+			_ = tcp.CloseWrite()
+		}
+		done <- struct{}{}
+	}()
+	go func() {
+		_, _ = io.Copy(channel, c)
+		_ = channel.CloseWrite()
+		done <- struct{}{}
+	}()
+	<-done
+	<-done
+}